@@ -3,15 +3,17 @@ package binlog
 // Based on the idea https://github.com/ScottMansfield/nanolog/issues/4
 import (
 	"bytes"
-	"crypto/md5"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 	"os"
 	"reflect"
 	"runtime"
+	"strings"
 	"sync/atomic"
+	"time"
 	"unicode/utf8"
 	"unsafe"
 
@@ -40,11 +42,83 @@ var ADD_SOURCE_LINE = false
 // ADD_TIMESTAMP enables timestamping of the log messages
 var ADD_TIMESTAMP = false
 
+// ADD_FRAME_HEADER enables a sync marker (16 bits) and the length of the
+// frame (32 bits) in front of every log entry. The decoder uses the header
+// to skip a corrupted frame or a frame with an unknown hash and to find the
+// next frame in the binary stream
+var ADD_FRAME_HEADER = false
+
+// FRAME_SYNC is the sync marker the frame starts with if ADD_FRAME_HEADER is set
+const FRAME_SYNC uint16 = 0xB10C
+
+// FRAME_HEADER_SIZE is the size of the sync marker and the frame length
+const FRAME_HEADER_SIZE = 2 + 4
+
+// MAX_FRAME_SIZE is the largest frame the decoder accepts. Anything larger
+// is likely a corrupted frame length
+const MAX_FRAME_SIZE = 1 << 20
+
+// ADD_FRAME_CRC enables CRC32C (Castagnoli) of the frame (32 bits) at the end
+// of every log entry. The decoder verifies the checksum and detects bit flips
+// and truncated frames
+var ADD_FRAME_CRC = false
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ADD_DICTIONARY enables the dictionary records in the binary stream
+// Log() writes the stream header before the first log entry and the format
+// string (and the filename if ADD_SOURCE_LINE is set) before the first log
+// entry which uses the format string. The decoder does not need the
+// dictionary from the logger, for example, when following a live log file
+var ADD_DICTIONARY = false
+
+// HANDLER_PER_CALL_SITE enables a handler for every call to Log() in the
+// source code. The program counter of the caller is the key of the
+// handler instead of the address of the format string. Two calls sharing
+// the format string get different hashes, source lines and statistics even
+// if the linker deduplicates the string. The lookup is slower: I call
+// runtime.Callers() for every log entry
+// The handlers of the call sites remain until the logger is gone: a call
+// with the format strings built by fmt.Sprintf() adds a handler for every
+// string, L2_CACHE_SIZE does not limit the call sites
+var HANDLER_PER_CALL_SITE = false
+
+// MAX_STRING_LENGTH is the longest string argument Log() writes to the binary
+// stream. Log() truncates longer strings, the decoder adds the truncation
+// marker, see TRUNCATED_FMT. If ADD_FRAME_HEADER is set Log() truncates
+// the strings further to fit the frame in MAX_FRAME_SIZE. The decoder rejects
+// the strings longer than MAX_FRAME_SIZE, Log() uses the smaller limit, see
+// getMaxStringLength()
+var MAX_STRING_LENGTH = MAX_FRAME_SIZE / 2
+
+// L2_CACHE_SIZE is the maximum number of format strings in the L2 cache,
+// 0 - no limit (default). An application which builds the format strings
+// with fmt.Sprintf() creates a handler for every string. If the cache is
+// full I evict the least recently used handler. The decoder which relies on
+// GetDictionary() or WriteDictionary() fails to decode the evicted format
+// strings, the dictionary records (ADD_DICTIONARY) are not affected
+// The limit does not apply to HANDLER_PER_CALL_SITE, see getCallSiteHandler()
+var L2_CACHE_SIZE = 0
+
+// L2_CACHE_RENDER_TEXT enables formatting of the messages as text if the L2
+// cache is full. Instead of evicting a handler Log() calls fmt.Sprintf()
+// and writes the text with the generic "%s" handler. The handlers in the
+// cache remain
+var L2_CACHE_RENDER_TEXT = false
+
+// TEXT_FMT_STRING is the format string of the messages Log() renders as text
+const TEXT_FMT_STRING = "%s"
+
 var binlogIndex uint64
 
 type DecodeArg struct {
-	argType reflect.Type // type of the argument
-	argKind reflect.Kind // "kind" of the argument, for example int32
+	argType     reflect.Type   // type of the argument
+	argKind     reflect.Kind   // "kind" of the argument, for example int32
+	argTypeWord unsafe.Pointer // type of the argument in the interface{}
+}
+
+func newDecodeArg(argType reflect.Type) DecodeArg {
+	return DecodeArg{argType: argType, argKind: argType.Kind(), argTypeWord: getInterfaceType(reflect.Zero(argType).Interface())}
 }
 
 type HandlerArg struct {
@@ -65,6 +139,17 @@ type WriterControl interface {
 	FrameEnd(io.Writer)
 }
 
+// LockingWriterControl is a WriterControl which FrameStart() blocks other
+// goroutines until FrameEnd(), for example, WriterControlMutex. The hooks
+// write the markers from other goroutines and require the lock, see
+// Register()
+// TryFrameStart() is FrameStart() which gives up after the timeout, for
+// example, if the goroutine panicked between FrameStart() and FrameEnd()
+type LockingWriterControl interface {
+	WriterControl
+	TryFrameStart(ioWriter io.Writer, timeout time.Duration) bool
+}
+
 type WriterControlDummy struct {
 }
 
@@ -82,6 +167,14 @@ type Handler struct {
 	IndexUint        uint32  // hash of the format string
 	FilenameHashUint uint16  // hash of the filename
 	LineNumberUint   uint16  // source line number
+	CallSite         uintptr // program counter of the call if HANDLER_PER_CALL_SITE is set
+	Count            uint64  // number of log entries
+
+	inDictionary bool     // true if the dictionary record is in the binary stream
+	next         *Handler // the next handler in the same L1 slot
+	variant      *Handler // the same format string with different argument types
+	l2Prev       *Handler // the more recently used handler in the L2 cache
+	l2Next       *Handler // the less recently used handler in the L2 cache
 
 	// I can output only byte slices, therefore I keep slices
 	index        []byte // a running index of the handler
@@ -98,8 +191,51 @@ type Statistics struct {
 	L2CacheUsed    uint64
 	StringOffsetOk uint64
 	StringOOM      uint64
+
+	// Handlers evicted from the full L2 cache, see L2_CACHE_SIZE
+	L2CacheEvicted uint64
+	// Messages rendered as text, see L2_CACHE_RENDER_TEXT
+	L2CacheRendered uint64
+
+	// Strings sharing the L1 slot with another string
+	L1CacheCollision uint64
+
+	// Handlers which got the hash of another handler, see addHandler()
+	HashCollision uint64
+
+	// Frames larger than MAX_FRAME_SIZE, see fitStrings()
+	FrameTruncated uint64
+
+	// Allocated pages of the L1 cache
+	L1CachePages uint64
+
+	// Lookups of the string arguments if INTERN_CONST_STRINGS is set
+	ConstStringHit  uint64
+	ConstStringMiss uint64
+
+	// Lookups of the string arguments if INTERN_TABLE_SIZE is set
+	InternHit     uint64
+	InternMiss    uint64
+	InternEvicted uint64
+
+	// Lookups by the program counter if HANDLER_PER_CALL_SITE is set
+	CallSiteHit  uint64
+	CallSiteMiss uint64
+
+	// Cache hits with the argument types or the number of arguments
+	// different from the first call
+	ArgTypeMismatch uint64
+	// Handlers created for the different argument types
+	ArgTypeVariants uint64
 }
 
+// L1_PAGE_SHIFT is log2 of the number of handlers in the L1 cache page
+// A page covers 4KB of the segment (512 strings 8 bytes each) and takes 4KB
+const L1_PAGE_SHIFT = 9
+const L1_PAGE_SIZE = 1 << L1_PAGE_SHIFT
+
+type l1Page [L1_PAGE_SIZE]*Handler
+
 type Config struct {
 	IOWriter      io.Writer
 	WriterControl WriterControl
@@ -115,13 +251,25 @@ type Binlog struct {
 	// Index in this array is a virtual address of the format string
 	// This is for fast lookup of constant strings from the executable
 	// code section
-	L1Cache []*Handler
+	// The array is split to pages of L1_PAGE_SIZE handlers. Most of the
+	// segment does not contain format strings and I allocate a page when
+	// the first string in the page appears
+	L1Cache []*l1Page
 
 	// Index in this array is the string itself
 	// I need this map for lookup of strings which address is not
 	// part of the executable code section
 	// L2Cache is 8x slower than L1Cache in the benchmark
 	L2Cache map[string]*Handler
+	l2Head  *Handler // the most recently used handler
+	l2Tail  *Handler // the least recently used handler
+
+	// The "%s" handler if L2_CACHE_RENDER_TEXT is set
+	textHandler *Handler
+
+	// Index in this map is the program counter of the caller
+	// Only if HANDLER_PER_CALL_SITE is true
+	callSites map[uintptr]*Handler
 
 	// All filenames I encountered
 	// Only if ADD_SOURCE_LINE is true
@@ -130,7 +278,46 @@ type Binlog struct {
 	// This is map[format string hash]*Handler
 	// I need this map for decoding of the binary stream
 	handlersLookupByHash map[uint32]*Handler
+	hashUsers            map[uint32]int // handlers sharing the hash, see addHandler()
 	statistics           Statistics
+
+	// Sync marker and length of the frame if ADD_FRAME_HEADER is set
+	frameHeader [FRAME_HEADER_SIZE]byte
+
+	// Checksum of the frame if ADD_FRAME_CRC is set
+	crcWriter crcWriter
+	frameCRC  [4]byte
+
+	// True after Log() wrote the stream header if ADD_DICTIONARY is set
+	streamHeaderWritten bool
+
+	// Incremented every time a new format string appears
+	dictionaryVersion uint64
+
+	// Properties of the stream header, see SetProperty()
+	properties map[string]string
+
+	// Interned string arguments if INTERN_CONST_STRINGS is set
+	constStrings     map[uintptr]*constString // by the address of the string
+	constStringsByID []*constString
+	stringsByID      map[uint64]string // for GetDictionary()
+	pendingStrings   []*constString    // not in the binary stream yet if ADD_DICTIONARY is set
+	stringRefs       []stringRef       // interned arguments of the current log entry
+
+	// Runtime strings if INTERN_TABLE_SIZE is set
+	internTable    internTable
+	pendingDefines []*internEntry // the define records before the current log entry
+}
+
+// crcWriter updates the checksum of the frame and forwards the data to the IOWriter
+type crcWriter struct {
+	ioWriter io.Writer
+	crc      uint32
+}
+
+func (w *crcWriter) Write(data []byte) (int, error) {
+	w.crc = crc32.Update(w.crc, crc32cTable, data)
+	return w.ioWriter.Write(data)
 }
 
 // ALIGNMENT is the size of a pointer in the data section
@@ -148,9 +335,9 @@ func Init(ioWriter io.Writer, writerControl WriterControl, constDataBase uint, c
 // New returns a new instance of the logger
 // constDataBase is an address of the initialzied const data, constDataSize is it's size
 func New(config Config) *Binlog {
-	// allocate one handler more for handling default cases
+	// The pages are allocated on demand, see getHandler()
 	config.ConstDataSize = config.ConstDataSize / ALIGNMENT
-	L1Cache := make([]*Handler, config.ConstDataSize+1)
+	L1Cache := make([]*l1Page, config.ConstDataSize>>L1_PAGE_SHIFT+1)
 	L2Cache := make(map[string]*Handler)
 	filenames := make(map[uint16]string)
 	handlersLookupByHash := make(map[uint32]*Handler)
@@ -158,8 +345,13 @@ func New(config Config) *Binlog {
 		config:               config,
 		L1Cache:              L1Cache,
 		L2Cache:              L2Cache,
+		callSites:            make(map[uintptr]*Handler),
+		constStrings:         make(map[uintptr]*constString),
+		stringsByID:          make(map[uint64]string),
 		Filenames:            filenames,
 		handlersLookupByHash: handlersLookupByHash,
+		hashUsers:            make(map[uint32]int),
+		properties:           getLoggerProperties(),
 	}
 	return binlog
 }
@@ -170,266 +362,228 @@ func (b *Binlog) GetStatistics() Statistics {
 
 // Log is similar to fmt.Fprintf(b.config.IOWriter, fmtStr, args)
 func (b *Binlog) Log(fmtStr string, args ...interface{}) error {
+	// The caches and the dictionary change only between FrameStart() and
+	// FrameEnd(). A locking WriterControl protects WriteDictionary() called
+	// by the sinks and the hooks
+	b.config.WriterControl.FrameStart(b.config.IOWriter)
 	h, err := b.getHandler(fmtStr, args)
 	if err != nil {
+		b.config.WriterControl.FrameEnd(b.config.IOWriter)
 		return err
 	}
+	if h == b.textHandler {
+		args = []interface{}{fmt.Sprintf(fmtStr, args...)}
+	}
 
-	hArgs := h.Args.args
-	if len(hArgs) != len(args) {
-		return fmt.Errorf("Number of args %d does not match log line %d", len(args), len(hArgs))
+	if !argTypesMatch(h, args) {
+		if h, err = b.getVariant(h, args); err != nil {
+			b.config.WriterControl.FrameEnd(b.config.IOWriter)
+			return err
+		}
 	}
-	b.config.WriterControl.FrameStart(b.config.IOWriter)
-	b.config.IOWriter.Write(h.hash)
+	h.Count++
+	var stringRefs []stringRef
+	if INTERN_CONST_STRINGS || INTERN_TABLE_SIZE > 0 {
+		stringRefs = b.internStrings(h, args)
+	}
+	if ADD_DICTIONARY && (!h.inDictionary || len(b.pendingStrings) != 0) {
+		b.writeDictionaryRecords(h)
+	}
+	if len(b.pendingDefines) != 0 || b.internTable.reset {
+		b.writeDefineRecords()
+	}
+	var stringLimits []int
+	if ADD_FRAME_HEADER {
+		stringLimits = b.writeFrameHeader(h, args, stringRefs)
+	}
+	ioWriter := b.config.IOWriter
+	if ADD_FRAME_CRC {
+		b.crcWriter = crcWriter{ioWriter: ioWriter}
+		ioWriter = &b.crcWriter
+	}
+	ioWriter.Write(h.hash)
 
 	if SEND_STRING_INDEX {
-		b.config.IOWriter.Write(h.index)
+		ioWriter.Write(h.index)
 	}
 
 	if ADD_SOURCE_LINE {
-		b.config.IOWriter.Write(h.filenameHash)
-		b.config.IOWriter.Write(h.lineNumber)
+		ioWriter.Write(h.filenameHash)
+		ioWriter.Write(h.lineNumber)
 	}
 
 	if SEND_LOG_INDEX {
 		logIndex := atomic.AddUint64(&binlogIndex, 1)
 		writer := writerByteArray{count: 8}
-		(&writer).write(b.config.IOWriter, unsafe.Pointer(&logIndex))
+		(&writer).write(ioWriter, unsafe.Pointer(&logIndex))
 	}
 	if ADD_TIMESTAMP {
 		timestamp := b.config.Timestamp()
 		writer := writerByteArray{count: 8}
-		(&writer).write(b.config.IOWriter, unsafe.Pointer(&timestamp))
+		(&writer).write(ioWriter, unsafe.Pointer(&timestamp))
 	}
 
 	for i, arg := range args {
 		hArg := h.Args.args[i]
 		writer := hArg.writer
-		if err := b.writeArgumentToOutput(writer, arg); err != nil {
+		if stringRefs != nil && stringRefs[i].kind != stringPlain {
+			writeStringRef(ioWriter, stringRefs[i])
+			continue
+		}
+		if w, ok := writer.(*writerString); ok && stringLimits != nil {
+			w.writeLimited(ioWriter, getInterfaceData(arg), stringLimits[i])
+			continue
+		}
+		if err := writeArgumentToOutput(ioWriter, writer, arg); err != nil {
 			err = fmt.Errorf("Failed to write value %v", err)
 			break
 		}
 	}
+	if ADD_FRAME_CRC {
+		binary.LittleEndian.PutUint32(b.frameCRC[:], b.crcWriter.crc)
+		b.config.IOWriter.Write(b.frameCRC[:])
+	}
 	b.config.WriterControl.FrameEnd(b.config.IOWriter)
 	return err
 }
 
-type LogEntry struct {
-	Filename   string
-	LineNumber int
-	FmtString  string
-	Args       []interface{}
-	Index      uint64
-	Timestamp  int64
-}
-
-// DecodeNext converts one record from the binary stream to a human readable format
-func (b *Binlog) DecodeNext(reader io.Reader) (*LogEntry, error) {
-	indexTable, filenames := b.GetIndexTable()
-	return DecodeNext(reader, indexTable, filenames)
-}
-
-// DecodeNext converts one record from the binary stream to a human readable format
-// You want to fmt.Sprintf(LogEntry.fmtString, LogEntry.args)
-// This API is slow - relies heavily on reflection, allocates strings and slices.
-// The idea is that I will not call this API often, and when I call the API I
-// will have a serious machine dedicated to the the task
-//
-// Decoding of the binary log is a three steps process:
-// 1. Read 4 bytes hash from the stream
-// 2. find the format string and arguments in the L1 or L2 cache
-// 3. Read arguments from the binary stream
-func DecodeNext(reader io.Reader, indexTable map[uint32]*Handler, filenames map[uint16]string) (*LogEntry, error) {
-	var logEntry = &LogEntry{}
-	var h *Handler
-	// Read format string hash
-	if hashUint, err := readIntegerFromReader(reader, 4); err == nil {
-		var ok bool
-		if h, ok = indexTable[uint32(hashUint)]; !ok {
-			return nil, fmt.Errorf("Failed to find format string hash %x", hashUint)
-		}
-	} else {
-		return nil, err
-	}
-
+// Write the sync marker and the size of the frame
+// All fields of the frame except the strings have fixed size and I do not
+// need to buffer the frame to know it's length
+// The size does not include the CRC which follows the frame
+// The decoder skips the frames larger than MAX_FRAME_SIZE. If the frame is
+// too large I truncate the strings and return the length limits of the
+// arguments, see fitStrings()
+func (b *Binlog) writeFrameHeader(h *Handler, args []interface{}, stringRefs []stringRef) []int {
+	size := len(h.hash)
 	if SEND_STRING_INDEX {
-		// Read format string index
-		if index, err := readIntegerFromReader(reader, 4); err == nil {
-			if uint32(index) != h.IndexUint {
-				return nil, fmt.Errorf("Mismatch of the format string index: %d instead of %d", index, h.index)
-			}
-		} else {
-			return nil, fmt.Errorf("Failed to read format string index err=%v", err)
-		}
+		size += len(h.index)
 	}
 	if ADD_SOURCE_LINE {
-		// Read filename hash and source line number from the binary stream
-		if filenameHash, err := readIntegerFromReader(reader, 2); err == nil {
-			filename, ok := filenames[uint16(filenameHash)]
-			if !ok {
-				return nil, fmt.Errorf("Failed to find filename with hash %x", filenameHash)
-			}
-			logEntry.Filename = filename
-		}
-		if lineNumber, err := readIntegerFromReader(reader, 2); err == nil {
-			logEntry.LineNumber = int(lineNumber)
-		} else {
-			return nil, fmt.Errorf("Failed to read source file linenumber err=%v", err)
-		}
+		size += len(h.filenameHash) + len(h.lineNumber)
 	}
 	if SEND_LOG_INDEX {
-		// Read log index - running counter of logs
-		if logEntryIndex, err := readIntegerFromReader(reader, 8); err == nil {
-			logEntry.Index = logEntryIndex
-		} else {
-			return nil, fmt.Errorf("Failed to read log index err=%v", err)
-		}
+		size += 8
 	}
 	if ADD_TIMESTAMP {
-		// Read 64 bits of timestamp from the stream
-		if timestamp, err := readIntegerFromReader(reader, 8); err == nil {
-			logEntry.Timestamp = int64(timestamp)
-		} else {
-			return nil, fmt.Errorf("Failed to read timestamp err=%v", err)
+		size += 8
+	}
+	for i, arg := range args {
+		if stringRefs != nil && stringRefs[i].kind != stringPlain {
+			size += getStringRefSize(stringRefs[i])
+			continue
 		}
+		size += h.Args.args[i].writer.getDataSize(getInterfaceData(arg))
+	}
+	var stringLimits []int
+	if size > MAX_FRAME_SIZE {
+		stringLimits, size = fitStrings(h, args, stringRefs, size)
+		b.statistics.FrameTruncated++
 	}
+	binary.LittleEndian.PutUint16(b.frameHeader[0:], FRAME_SYNC)
+	binary.LittleEndian.PutUint32(b.frameHeader[2:], uint32(size))
+	b.config.IOWriter.Write(b.frameHeader[:])
+	return stringLimits
+}
 
-	hFmtString := h.Args.fmtString
-	args := make([]interface{}, 0)
-	var value interface{}
-	var err error
-	// Read arguments from the binary stream
-	for _, hArg := range h.Args.args {
-		argType := hArg.decodeArg.argType
-		if isIntegral(argType) {
-			count := hArg.writer.getSize() // size of the integer I pushed into the binary stream
-			value, err = readIntegerFromReader(reader, count)
-		} else if hArg.decodeArg.argKind == reflect.String {
-			value, err = readStringFromReader(reader)
-		} else {
-			return nil, fmt.Errorf("Can not handle type %v", argType)
+// Share MAX_FRAME_SIZE between the string arguments. The short strings
+// remain intact, the long strings get equal shares of the rest. Returns
+// the length limits of the arguments and the new size of the frame
+func fitStrings(h *Handler, args []interface{}, stringRefs []stringRef, size int) ([]int, int) {
+	limits := make([]int, len(args))
+	lengths := make([]int, len(args))
+	count := 0
+	for i, arg := range args {
+		limits[i] = getMaxStringLength()
+		lengths[i] = -1
+		if stringRefs != nil && stringRefs[i].kind != stringPlain {
+			continue
 		}
-		if err == nil {
-			args, err = appendArg(args, value, argType)
-			if err != nil {
-				return nil, fmt.Errorf("%v", err)
+		if w, ok := h.Args.args[i].writer.(*writerString); ok {
+			data := getInterfaceData(arg)
+			size -= w.getDataSize(data)
+			lengths[i] = getTruncatedLength((*reflect.StringHeader)(data).Len, getMaxStringLength())
+			count++
+		}
+	}
+	// The header of the truncated string is up to two varints
+	budget := MAX_FRAME_SIZE - size - count*2*binary.MaxVarintLen64
+	if budget < 0 {
+		budget = 0
+	}
+	for fitted := true; fitted && count > 0; {
+		fitted = false
+		share := budget / count
+		for i, length := range lengths {
+			if length >= 0 && length <= share {
+				budget -= length
+				lengths[i] = -1
+				count--
+				fitted = true
 			}
-		} else {
-			return nil, fmt.Errorf("%v", err)
 		}
 	}
-	logEntry.Args = args
-	logEntry.FmtString = hFmtString
-	return logEntry, nil
-}
-
-// GetIndexTable returns a map[hash]
-// Application can use the map for decoding of the binary stread
-// Pay attention that the map is getting updated every time a new string appears
-func (b *Binlog) GetIndexTable() (map[uint32]*Handler, map[uint16]string) {
-	return b.handlersLookupByHash, b.Filenames
+	for i, length := range lengths {
+		if length >= 0 {
+			limits[i] = budget / count
+		}
+	}
+	for i, arg := range args {
+		if w, ok := h.Args.args[i].writer.(*writerString); ok && (stringRefs == nil || stringRefs[i].kind == stringPlain) {
+			size += w.getLimitedSize(getInterfaceData(arg), limits[i])
+		}
+	}
+	return limits, size
 }
 
-func isIntegral(t reflect.Type) bool {
-	switch t.Kind() {
-	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return true
-	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return true
-	case reflect.Int, reflect.Uint:
-		return true
-	default:
-		return false
+// Write the stream header before the first log entry and the format string
+// before the first log entry which uses the format string. Same for the
+// interned strings
+// The filename records can repeat, this is cheaper than a lookup
+func (b *Binlog) writeDictionaryRecords(h *Handler) {
+	if !b.streamHeaderWritten {
+		options := DefaultDecoderOptions()
+		writeRecord(b.config.IOWriter, encodeStreamHeader(&options, b.properties))
+		b.streamHeaderWritten = true
+	}
+	if !h.inDictionary {
+		if ADD_SOURCE_LINE {
+			writeRecord(b.config.IOWriter, encodeFilename(h.FilenameHashUint, b.Filenames[h.FilenameHashUint]))
+		}
+		writeRecord(b.config.IOWriter, encodeHandler(h))
+		h.inDictionary = true
 	}
+	for _, s := range b.pendingStrings {
+		writeRecord(b.config.IOWriter, encodeString(s.id, s.value))
+	}
+	b.pendingStrings = b.pendingStrings[:0]
 }
 
-func isUnsigned(t reflect.Type) bool {
-	switch t.Kind() {
-	case reflect.Uint, reflect.Uint32, reflect.Uint64, reflect.Uint8, reflect.Uint16:
-		return true
-	default:
-		return false
-	}
+// DecodeNext converts one record from the binary stream to a human readable format
+// DecodeNext does not support INTERN_TABLE_SIZE, see DecodeNext()
+func (b *Binlog) DecodeNext(reader io.Reader) (*LogEntry, error) {
+	indexTable, filenames := b.GetIndexTable()
+	return DecodeNext(reader, indexTable, filenames)
 }
 
-func readIntegerFromReader(reader io.Reader, count int) (uint64, error) {
-	slice := make([]byte, count)
-	n, err := reader.Read(slice)
-	if (n > 0) && (n != count) {
-		return 0, fmt.Errorf("Read %d bytes instead of %d, err=%v", n, count, err)
-	} else if n == 0 {
-		return 0, fmt.Errorf("EOF")
-	}
-	switch count {
-	case 1:
-		var value uint8
-		binary.Read(bytes.NewBuffer(slice[:]), binary.LittleEndian, &value)
-		return uint64(value), nil
-	case 2:
-		var value uint16
-		binary.Read(bytes.NewBuffer(slice[:]), binary.LittleEndian, &value)
-		return uint64(value), nil
-	case 4:
-		var value uint32
-		binary.Read(bytes.NewBuffer(slice[:]), binary.LittleEndian, &value)
-		return uint64(value), nil
-	default:
-		var value uint64
-		binary.Read(bytes.NewBuffer(slice[:]), binary.LittleEndian, &value)
-		return uint64(value), nil
-	}
+// GetDictionary returns the index table and the filenames for NewDecoder()
+// Pay attention that the maps are getting updated every time a new string appears
+func (b *Binlog) GetDictionary() *Dictionary {
+	return &Dictionary{Handlers: b.handlersLookupByHash, Filenames: b.Filenames, Strings: b.stringsByID}
 }
 
-func readStringFromReader(reader io.Reader) (string, error) {
-	// Read 2 bytes of the size of the string
-	count := 2
-	slice := make([]byte, count)
-	n, err := reader.Read(slice)
-	if (n > 0) && (n != count) {
-		return "", fmt.Errorf("Read %d bytes instead of %d, err=%v", n, count, err)
-	} else if n == 0 {
-		return "", fmt.Errorf("EOF")
-	}
-	var value uint16
-	binary.Read(bytes.NewBuffer(slice[:]), binary.LittleEndian, &value)
-	count = int(value)
-	slice = make([]byte, count)
-	n, err = reader.Read(slice)
-	if (n > 0) && (n != count) {
-		return "", fmt.Errorf("Read %d bytes instead of %d, err=%v", n, count, err)
-	} else if n == 0 {
-		return "", fmt.Errorf("EOF")
-	}
-	return string(slice), nil
+// DictionaryVersion changes every time a new format string appears
+// The sinks call DictionaryVersion() in FrameEnd() and update the copy
+// of the dictionary if required, see NetworkSink
+func (b *Binlog) DictionaryVersion() uint64 {
+	return b.dictionaryVersion
 }
 
-func appendArg(args []interface{}, arg interface{}, argType reflect.Type) ([]interface{}, error) {
-	switch value := arg.(type) {
-	case int:
-		return append(args, int(value)), nil
-	case uint:
-		return append(args, uint(value)), nil
-	case int8:
-		return append(args, int8(value)), nil
-	case int16:
-		return append(args, int16(value)), nil
-	case int32:
-		return append(args, int32(value)), nil
-	case int64:
-		return append(args, int64(value)), nil
-	case uint8:
-		return append(args, uint8(value)), nil
-	case uint16:
-		return append(args, uint16(value)), nil
-	case uint32:
-		return append(args, uint32(value)), nil
-	case uint64:
-		return append(args, uint64(value)), nil
-	case string:
-		return append(args, string(value)), nil
-	default:
-		return nil, fmt.Errorf("Can not handle type %v", argType.Kind())
-	}
+// GetIndexTable returns a map[hash]
+// Application can use the map for decoding of the binary stread
+// Pay attention that the map is getting updated every time a new string appears
+func (b *Binlog) GetIndexTable() (map[uint32]*Handler, map[uint16]string) {
+	return b.handlersLookupByHash, b.Filenames
 }
 
 func getStringAddress(s string) uint {
@@ -441,7 +595,7 @@ func getStringAddress(s string) uint {
 // Returning one integer shaves 10% off the overall vs return uint, error
 // Golang inlines this function?
 func (b *Binlog) getStringIndex(s string) uint {
-	sDataOffset := (getStringAddress(s) - b.config.ConstDataBase) / ALIGNMENT
+	sDataOffset := b.getStringOffset(s)
 	if sDataOffset < b.config.ConstDataSize {
 		b.statistics.StringOffsetOk++
 		return sDataOffset
@@ -452,10 +606,28 @@ func (b *Binlog) getStringIndex(s string) uint {
 	}
 }
 
-func md5sum(s string) uint32 {
-	md5sum := md5.Sum([]byte(s))
-	var hash uint32
-	binary.Read(bytes.NewBuffer(md5sum[:]), binary.LittleEndian, &hash)
+// The offset of the string in the const data, ConstDataSize or larger if the
+// string is not in the const data. Unlike getStringIndex() does not update
+// the statistics of the format strings
+func (b *Binlog) getStringOffset(s string) uint {
+	return (getStringAddress(s) - b.config.ConstDataBase) / ALIGNMENT
+}
+
+// FNV-1a hash of the string. The salt, if not zero, precedes the string
+// MD5 is about 8x slower on the cache miss path and I do not need a
+// cryptographic hash
+func hashString(s string, salt uint32) uint32 {
+	hash := uint32(2166136261)
+	if salt != 0 {
+		for i := 0; i < 4; i++ {
+			hash ^= (salt >> (8 * i)) & 0xFF
+			hash *= 16777619
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		hash ^= uint32(s[i])
+		hash *= 16777619
+	}
 	return hash
 }
 
@@ -482,11 +654,58 @@ func (b *Binlog) createHandler(fmtStr string, args []interface{}) (*Handler, err
 		h.IndexUint = index
 	}
 
-	hash := md5sum(fmtStr)
+	return &h, nil
+}
+
+// Set the hash of the handler and add the handler to the dictionary
+// The key is the format string or the format string and the call site or
+// the argument types. If another handler has the same 32 bits hash I
+// hash the key again with a salt 1, 2, ... until the hash is unique. The
+// dictionary keeps the hash, the decoder does not repeat the calculation
+// The hash DICTIONARY_HASH is reserved for the dictionary records
+func (b *Binlog) addHandler(h *Handler, key string) {
+	hash := hashString(key, 0)
+	for salt := uint32(1); ; salt++ {
+		other, ok := b.handlersLookupByHash[hash]
+		if hash != DICTIONARY_HASH && (!ok || other.isEquivalent(h)) {
+			break
+		}
+		b.statistics.HashCollision++
+		hash = hashString(key, salt)
+	}
 	h.hash = intToSlice(&hash)
 	h.HashUint = hash
+	// The equivalent handler remains in the dictionary, evictL2() removes
+	// the hash when the last handler is gone
+	if _, ok := b.handlersLookupByHash[hash]; !ok {
+		b.handlersLookupByHash[hash] = h
+	}
+	b.hashUsers[hash]++
+}
 
-	return &h, nil
+// Handlers of the same format string with the same arguments, for example,
+// in the L1 and in the L2 cache, produce the same log entries and can share
+// the hash
+func (h *Handler) isEquivalent(other *Handler) bool {
+	if h.Args.fmtString != other.Args.fmtString || h.IndexUint != other.IndexUint ||
+		h.CallSite != other.CallSite || len(h.Args.args) != len(other.Args.args) {
+		return false
+	}
+	for i, hArg := range h.Args.args {
+		otherArg := other.Args.args[i]
+		if hArg.fmtVerb != otherArg.fmtVerb || hArg.decodeArg.argKind != otherArg.decodeArg.argKind ||
+			hArg.writer.getSize() != otherArg.writer.getSize() {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Handler) setSourceLine(filename string, line int) {
+	h.FilenameHashUint = uint16(hashString(filename, 0))
+	h.LineNumberUint = uint16(line)
+	h.filenameHash = intToSlice(&h.FilenameHashUint)
+	h.lineNumber = intToSlice(&h.LineNumberUint)
 }
 
 // My hashtable is trivial: address of the string is an index in the array of handlers
@@ -498,10 +717,22 @@ func (b *Binlog) getHandler(fmtStr string, args []interface{}) (*Handler, error)
 	var err error
 	var sIndex uint
 	var isMiss = false
+	if HANDLER_PER_CALL_SITE {
+		return b.getCallSiteHandler(fmtStr, args)
+	}
 	sIndex = b.getStringIndex(fmtStr)
 	if sIndex != b.config.ConstDataSize {
-		h = b.L1Cache[sIndex]
-		if h != nil { // fast cache hit? (20% of the whole function is here. Blame CPU data cache?)
+		page := b.L1Cache[sIndex>>L1_PAGE_SHIFT]
+		h = nil
+		if page != nil {
+			h = page[sIndex&(L1_PAGE_SIZE-1)]
+		}
+		// The string literals are not aligned, many strings can share the
+		// same 8 bytes. I compare the address and the length
+		address := uintptr(getStringAddress(fmtStr))
+		if h != nil && h.Address == address && len(h.Args.fmtString) == len(fmtStr) { // fast cache hit? (20% of the whole function is here. Blame CPU data cache?)
+			b.statistics.L1CacheHit++
+		} else if h = b.lookupL1Collision(h, address, len(fmtStr)); h != nil {
 			b.statistics.L1CacheHit++
 		} else {
 			isMiss = true
@@ -511,8 +742,19 @@ func (b *Binlog) getHandler(fmtStr string, args []interface{}) (*Handler, error)
 				log.Printf("%v", err)
 				return nil, err
 			}
-			b.L1Cache[sIndex] = h
-			b.handlersLookupByHash[h.HashUint] = h
+			h.Address = address
+			h.IsL1Cache = true
+			if page == nil {
+				page = &l1Page{}
+				b.L1Cache[sIndex>>L1_PAGE_SHIFT] = page
+				b.statistics.L1CachePages++
+			}
+			if slot := page[sIndex&(L1_PAGE_SIZE-1)]; slot != nil {
+				b.statistics.L1CacheCollision++
+				h.next = slot
+			}
+			page[sIndex&(L1_PAGE_SIZE-1)] = h
+			b.addHandler(h, fmtStr)
 		}
 	} else {
 		b.statistics.L2CacheUsed++
@@ -520,6 +762,21 @@ func (b *Binlog) getHandler(fmtStr string, args []interface{}) (*Handler, error)
 		var ok bool
 		if h, ok = b.L2Cache[fmtStr]; ok {
 			b.statistics.L2CacheHit++
+			if b.l2Head != h {
+				b.removeL2(h)
+				b.pushFrontL2(h)
+			}
+		} else if L2_CACHE_RENDER_TEXT && L2_CACHE_SIZE > 0 && len(b.L2Cache) >= L2_CACHE_SIZE {
+			b.statistics.L2CacheRendered++
+			if b.textHandler != nil {
+				return b.textHandler, nil
+			}
+			isMiss = true
+			if h, err = b.createHandler(TEXT_FMT_STRING, []interface{}{""}); err != nil {
+				return nil, err
+			}
+			b.textHandler = h
+			b.addHandler(h, TEXT_FMT_STRING)
 		} else {
 			isMiss = true
 			b.statistics.L2CacheMiss++
@@ -528,29 +785,163 @@ func (b *Binlog) getHandler(fmtStr string, args []interface{}) (*Handler, error)
 				log.Printf("%v", err)
 				return nil, err
 			}
+			for L2_CACHE_SIZE > 0 && len(b.L2Cache) >= L2_CACHE_SIZE {
+				b.evictL2()
+			}
 			b.L2Cache[fmtStr] = h
-			b.handlersLookupByHash[h.HashUint] = h
+			b.pushFrontL2(h)
+			b.addHandler(h, fmtStr)
 		}
 	}
 	// Set filename and source line number
 	if ADD_SOURCE_LINE && isMiss {
-		var filenameHash uint16 = 0xBADB
-		var fileLine uint16 = 0xADBA
 		// Caller(0) is this function, Caller(1) is Log()
 		_, filename, line, ok := runtime.Caller(2)
 		if ok {
-			filenameHash = uint16(md5sum(filename))
-			fileLine = uint16(line)
+			h.setSourceLine(filename, line)
+		} else {
+			var filenameHash uint16 = 0xBADB
+			var fileLine uint16 = 0xADBA
+			h.FilenameHashUint = filenameHash
+			h.LineNumberUint = fileLine
+			h.filenameHash = intToSlice(&filenameHash)
+			h.lineNumber = intToSlice(&fileLine)
 		}
-		h.FilenameHashUint = filenameHash
-		h.LineNumberUint = fileLine
-		h.filenameHash = intToSlice(&filenameHash)
-		h.lineNumber = intToSlice(&fileLine)
 		b.Filenames[h.FilenameHashUint] = filename
 	}
+	if isMiss {
+		b.dictionaryVersion++
+	}
+	return h, nil
+}
+
+// Remove the least recently used handler and the variants of the handler
+// from the L2 cache and from the dictionary
+func (b *Binlog) evictL2() {
+	h := b.l2Tail
+	b.removeL2(h)
+	delete(b.L2Cache, h.Args.fmtString)
+	// The L1 cache can keep the same format string with the same hash
+	for variant := h; variant != nil; variant = variant.variant {
+		if b.hashUsers[variant.HashUint]--; b.hashUsers[variant.HashUint] == 0 {
+			delete(b.hashUsers, variant.HashUint)
+			delete(b.handlersLookupByHash, variant.HashUint)
+		}
+	}
+	b.statistics.L2CacheEvicted++
+}
+
+func (b *Binlog) removeL2(h *Handler) {
+	if h.l2Prev != nil {
+		h.l2Prev.l2Next = h.l2Next
+	} else {
+		b.l2Head = h.l2Next
+	}
+	if h.l2Next != nil {
+		h.l2Next.l2Prev = h.l2Prev
+	} else {
+		b.l2Tail = h.l2Prev
+	}
+	h.l2Prev, h.l2Next = nil, nil
+}
+
+func (b *Binlog) pushFrontL2(h *Handler) {
+	h.l2Next = b.l2Head
+	if b.l2Head != nil {
+		b.l2Head.l2Prev = h
+	} else {
+		b.l2Tail = h
+	}
+	b.l2Head = h
+}
+
+// The format string and the source line identify the handler. The handlers
+// of the format strings the caller uses share the map entry
+func (b *Binlog) getCallSiteHandler(fmtStr string, args []interface{}) (*Handler, error) {
+	var pcs [1]uintptr
+	// Callers(0) is runtime.Callers, Callers(1) is this function, Callers(2) is
+	// getHandler(), Callers(3) is Log()
+	runtime.Callers(4, pcs[:])
+	pc := pcs[0]
+	for h := b.callSites[pc]; h != nil; h = h.next {
+		if h.Args.fmtString == fmtStr {
+			b.statistics.CallSiteHit++
+			return h, nil
+		}
+	}
+	b.statistics.CallSiteMiss++
+	h, err := b.createHandler(fmtStr, args)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil, err
+	}
+	frame, _ := runtime.CallersFrames(pcs[:]).Next()
+	h.CallSite = pc
+	b.addHandler(h, fmt.Sprintf("%s\x00%s:%d", fmtStr, frame.File, frame.Line))
+	if ADD_SOURCE_LINE {
+		h.setSourceLine(frame.File, frame.Line)
+		b.Filenames[h.FilenameHashUint] = frame.File
+	}
+	h.next = b.callSites[pc]
+	b.callSites[pc] = h
+	b.dictionaryVersion++
 	return h, nil
 }
 
+// The handler keeps the types of the arguments of the first call. If the
+// application calls Log() with the same format string and other types, for
+// example, int8 and then int64, or a missing argument, I need another
+// handler: the size of the arguments in the binary stream is different. The variants of the handler
+// are in a list. The hash of the variant includes the argument types
+func (b *Binlog) getVariant(h *Handler, args []interface{}) (*Handler, error) {
+	b.statistics.ArgTypeMismatch++
+	for variant := h.variant; variant != nil; variant = variant.variant {
+		if argTypesMatch(variant, args) {
+			return variant, nil
+		}
+	}
+	variant, err := b.createHandler(h.Args.fmtString, args)
+	if err != nil {
+		return nil, err
+	}
+	signature := fmt.Sprintf("%s\x00%d", h.Args.fmtString, len(args))
+	for _, arg := range args {
+		signature += fmt.Sprintf("\x00%T", arg)
+	}
+	variant.Address, variant.IsL1Cache, variant.CallSite = h.Address, h.IsL1Cache, h.CallSite
+	variant.FilenameHashUint, variant.LineNumberUint = h.FilenameHashUint, h.LineNumberUint
+	variant.filenameHash, variant.lineNumber = h.filenameHash, h.lineNumber
+	variant.variant = h.variant
+	h.variant = variant
+	b.addHandler(variant, signature)
+	b.dictionaryVersion++
+	b.statistics.ArgTypeVariants++
+	return variant, nil
+}
+
+func argTypesMatch(h *Handler, args []interface{}) bool {
+	if len(h.Args.args) != len(args) {
+		return false
+	}
+	for i, arg := range args {
+		if getInterfaceType(arg) != h.Args.args[i].decodeArg.argTypeWord {
+			return false
+		}
+	}
+	return true
+}
+
+// Walk the handlers sharing the L1 slot, returns nil if there is no
+// handler for the string
+func (b *Binlog) lookupL1Collision(h *Handler, address uintptr, length int) *Handler {
+	for ; h != nil; h = h.next {
+		if h.Address == address && len(h.Args.fmtString) == length {
+			return h
+		}
+	}
+	return nil
+}
+
 func (b *Binlog) writeArgumentToOutput_Slow(writer writer, arg interface{}) error {
 	var err error
 	rv := reflect.ValueOf(arg)
@@ -619,6 +1010,10 @@ func getInterfaceData(arg interface{}) unsafe.Pointer {
 	return unsafe.Pointer((((*iface)(unsafe.Pointer(&arg))).data))
 }
 
+func getInterfaceType(arg interface{}) unsafe.Pointer {
+	return unsafe.Pointer((((*iface)(unsafe.Pointer(&arg))).tab))
+}
+
 // Cast the integer argument to uint64 and call a "writer"
 // The "writer" knows how many bytes to add to the binary stream
 //
@@ -627,11 +1022,11 @@ func getInterfaceData(arg interface{}) unsafe.Pointer {
 // Switching to args *[]interface makes the performance 2x worse
 // Before you jump to conclusions see
 // https://groups.google.com/forum/#!topic/golang-nuts/Og8s9Y-Kif4
-func (b *Binlog) writeArgumentToOutput(writer writer, arg interface{}) error {
+func writeArgumentToOutput(ioWriter io.Writer, writer writer, arg interface{}) error {
 	var err error
 	// writer.write() expects an unsafe pointer
 	// writer will copy the required number of bytes to the output binary stream
-	err = writer.write(b.config.IOWriter, getInterfaceData(arg))
+	err = writer.write(ioWriter, getInterfaceData(arg))
 	return err
 }
 
@@ -658,28 +1053,61 @@ func parseLogLine(gold string, args []interface{}) ([]*HandlerArg, error) {
 		}
 		// Literal % sign
 		if peek(f) == '%' {
+			next(f)
 			continue
 		}
 		r, _ = next(f)
+		if !strings.ContainsRune("xdics", r) {
+			return nil, fmt.Errorf("Can not handle '%c' in %s: unknown format code", r, gold)
+		}
+		// fmt.Sprintf() prints %!d(MISSING), so does the decoder
+		if argIndex >= len(args) {
+			continue
+		}
 		arg := args[argIndex]
+		if arg == nil {
+			return nil, fmt.Errorf("Can not handle nil for '%c' in %s", r, gold)
+		}
 		argType := reflect.TypeOf(arg)
-		argKind := argType.Kind()
 		count := int(argType.Size()) // number of bytes in the argument
 		switch r {
 		case 'x', 'd', 'i', 'c':
+			if !isIntegral(argType) {
+				return nil, fmt.Errorf("Can not handle %s for '%c' in %s: not an integer", argType, r, gold)
+			}
 			writer := &writerByteArray{count: count}
-			hArg := &HandlerArg{writer: writer, fmtVerb: r, decodeArg: DecodeArg{argType: argType, argKind: argKind}}
+			hArg := &HandlerArg{writer: writer, fmtVerb: r, decodeArg: newDecodeArg(argType)}
 			hArgs = append(hArgs, hArg)
 		case 's':
+			if argType.Kind() != reflect.String {
+				return nil, fmt.Errorf("Can not handle %s for '%c' in %s: not a string", argType, r, gold)
+			}
 			writer := &writerString{}
-			hArg := &HandlerArg{writer: writer, fmtVerb: r, decodeArg: DecodeArg{argType: argType, argKind: argKind}}
+			hArg := &HandlerArg{writer: writer, fmtVerb: r, decodeArg: newDecodeArg(argType)}
 			hArgs = append(hArgs, hArg)
-		default:
-			return nil, fmt.Errorf("Can not handle '%c' in %s: unknown format code", r, gold)
 		}
 		argIndex++
 	}
 
+	// fmt.Sprintf() prints %!(EXTRA int=1) for the extra arguments. I keep
+	// the extra arguments in the binary stream, the decoder calls
+	// fmt.Sprintf() with the same arguments
+	for _, arg := range args[argIndex:] {
+		if arg == nil {
+			return nil, fmt.Errorf("Can not handle extra nil in %s", gold)
+		}
+		argType := reflect.TypeOf(arg)
+		var writer writer
+		if isIntegral(argType) {
+			writer = &writerByteArray{count: int(argType.Size())}
+		} else if argType.Kind() == reflect.String {
+			writer = &writerString{}
+		} else {
+			return nil, fmt.Errorf("Can not handle extra %s in %s", argType, gold)
+		}
+		hArgs = append(hArgs, &HandlerArg{writer: writer, fmtVerb: 'v', decodeArg: newDecodeArg(argType)})
+	}
+
 	return hArgs, nil
 }
 
@@ -735,6 +1163,9 @@ type writer interface {
 	write(io.Writer, unsafe.Pointer) error
 
 	getSize() int
+
+	// number of bytes write() adds to the binary stream
+	getDataSize(unsafe.Pointer) int
 }
 
 type writerByteArray struct {
@@ -745,6 +1176,10 @@ func (w *writerByteArray) getSize() int {
 	return w.count
 }
 
+func (w *writerByteArray) getDataSize(data unsafe.Pointer) int {
+	return w.count
+}
+
 // Copy w.count bytes from the unsafe pointer to the byte stream
 func (w *writerByteArray) write(ioWriter io.Writer, data unsafe.Pointer) error {
 	// I am doing something which https://golang.org/pkg/unsafe/ explicitly forbids
@@ -766,17 +1201,69 @@ func (w *writerString) getSize() int {
 	return 0
 }
 
-// Write 16 bits length of the string followed by the string itself
-// TODO: if the string is const I need only it's hash
+func (w *writerString) getDataSize(data unsafe.Pointer) int {
+	return w.getLimitedSize(data, getMaxStringLength())
+}
+
+// The size of the string truncated to the limit, including the header
+func (w *writerString) getLimitedSize(data unsafe.Pointer, limit int) int {
+	var header [2 * binary.MaxVarintLen64]byte
+	length := (*reflect.StringHeader)(data).Len
+	return putStringHeader(header[:], length, limit) + getTruncatedLength(length, limit)
+}
+
+// MAX_STRING_LENGTH limited to the strings the decoder accepts
+func getMaxStringLength() int {
+	if MAX_STRING_LENGTH > MAX_FRAME_SIZE {
+		return MAX_FRAME_SIZE
+	}
+	return MAX_STRING_LENGTH
+}
+
+// Returns the number of bytes of the string Log() writes
+func getTruncatedLength(length int, limit int) int {
+	if length > limit {
+		return limit
+	}
+	return length
+}
+
+// Kinds of the string arguments in the binary stream
+const (
+	stringPlain     = 0 // the string follows the header
+	stringTruncated = 1 // the number of dropped bytes and the string follow the header
+	stringInterned  = 2 // the header contains the ID of the string in the dictionary
+	stringDynamic   = 3 // the header contains the slot in the intern table, see INTERN_TABLE_SIZE
+)
+
+// The string header is varint of (length << 2 | kind). If the string is
+// truncated the number of dropped bytes (varint) follows
+func putStringHeader(header []byte, length int, limit int) int {
+	truncatedLength := getTruncatedLength(length, limit)
+	if truncatedLength == length {
+		return binary.PutUvarint(header, uint64(length)<<2|stringPlain)
+	}
+	n := binary.PutUvarint(header, uint64(truncatedLength)<<2|stringTruncated)
+	return n + binary.PutUvarint(header[n:], uint64(length-truncatedLength))
+}
+
+// Write the string header followed by the string itself
+// If INTERN_CONST_STRINGS or INTERN_TABLE_SIZE is set Log() can write the
+// ID of the string instead, see writeStringRef()
 func (w *writerString) write(ioWriter io.Writer, data unsafe.Pointer) error {
+	return w.writeLimited(ioWriter, data, getMaxStringLength())
+}
+
+// Write the string truncated to the limit, see fitStrings()
+func (w *writerString) writeLimited(ioWriter io.Writer, data unsafe.Pointer, limit int) error {
 	// I am doing something which https://golang.org/pkg/unsafe/ explicitly forbids
 	var hdr = (*reflect.StringHeader)(data)
-	writer := &writerByteArray{2}
-	if err := writer.write(ioWriter, unsafe.Pointer(&(hdr.Len))); err != nil {
+	var header [2 * binary.MaxVarintLen64]byte
+	if _, err := ioWriter.Write(header[:putStringHeader(header[:], hdr.Len, limit)]); err != nil {
 		return err
 	}
 
-	writer = &writerByteArray{hdr.Len}
+	writer := &writerByteArray{getTruncatedLength(hdr.Len, limit)}
 	if err := writer.write(ioWriter, unsafe.Pointer(hdr.Data)); err != nil {
 		return err
 	}
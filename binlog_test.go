@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"debug/elf"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -196,7 +197,7 @@ func TestInt(t *testing.T) {
 		if err != nil {
 			t.Fatalf("Failed to read filename %v", err)
 		}
-		expectedFilenameHash := uint16(md5sum(filename))
+		expectedFilenameHash := uint16(hashString(filename, 0))
 		expectedLineNumber := uint16(line + 1)
 		if filenameHash != expectedFilenameHash {
 			t.Fatalf("Filename hash is %x instead of %x for file '%s'", filenameHash, expectedFilenameHash, filename)
@@ -809,6 +810,40 @@ func BenchmarkEmptyString(b *testing.B) {
 	//b.Logf(sprintf.SprintfStructure(statistics, 4, "  %15s %9d", nil))
 }
 
+var benchmarkHandler *Handler
+
+// Compare the lookup in the L1 cache pages with the lookup in one flat array
+// of handlers
+func BenchmarkL1CacheLookup(b *testing.B) {
+	var buf DummyIoWriter
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	fmtString := "Hello"
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	binlog.Log(fmtString)
+	sIndex := binlog.getStringIndex(fmtString)
+	flat := make([]*Handler, constDataSize/ALIGNMENT+1)
+	flat[sIndex] = binlog.L1Cache[sIndex>>L1_PAGE_SHIFT][sIndex&(L1_PAGE_SIZE-1)]
+
+	b.Run("flat", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			benchmarkHandler = flat[binlog.getStringIndex(fmtString)]
+		}
+	})
+	b.Run("paged", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			sIndex := binlog.getStringIndex(fmtString)
+			if page := binlog.L1Cache[sIndex>>L1_PAGE_SHIFT]; page != nil {
+				benchmarkHandler = page[sIndex&(L1_PAGE_SIZE-1)]
+			}
+		}
+	})
+	b.Run("getHandler", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			benchmarkHandler, _ = binlog.getHandler(fmtString, nil)
+		}
+	})
+}
+
 // Force Go compiler to allocate an object every time
 // binlog.Log() is called. Performance suffers.
 // Go allocates integers from the heap?
@@ -951,6 +986,424 @@ func TestL2Cache(t *testing.T) {
 	}
 }
 
+// Substrings of a literal share the L1 slot: the same address and different
+// lengths or different addresses within 8 bytes
+func TestL1CacheCollision(t *testing.T) {
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	// The format strings start at the first aligned address in the literal
+	// and at the next byte, all four format strings share one slot
+	literal := "01234567Hello %d %d"
+	aligned := literal[(ALIGNMENT-getStringAddress(literal)%ALIGNMENT)%ALIGNMENT:]
+	fmtStrings := []string{aligned[:len(aligned)-3], aligned, aligned[1:], aligned[1 : len(aligned)-3]}
+	args := [][]interface{}{{1}, {2, 3}, {4, 5}, {6}}
+	for i := 0; i < 2; i++ {
+		for j, fmtString := range fmtStrings {
+			if err := binlog.Log(fmtString, args[j]...); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+	}
+	statistics := binlog.GetStatistics()
+	if statistics.L1CacheMiss != 4 || statistics.L1CacheHit != 4 || statistics.L1CacheCollision != 3 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), nil)
+	for i := 0; i < 2*len(fmtStrings); i++ {
+		j := i % len(fmtStrings)
+		if !decoder.Next() {
+			t.Fatalf("Failed to decode %v", decoder.Err())
+		}
+		expected := fmt.Sprintf(fmtStrings[j], args[j]...)
+		if actual := Format(decoder.Entry()); actual != expected {
+			t.Fatalf("Print failed expected '%s', actual '%s'", expected, actual)
+		}
+	}
+}
+
+// New() allocates only the page table, a page is allocated when the first
+// string in the page appears
+func TestL1CachePages(t *testing.T) {
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	if expected := constDataSize/ALIGNMENT/L1_PAGE_SIZE + 1; uint(len(binlog.L1Cache)) != expected {
+		t.Fatalf("Page table size is %d instead of %d", len(binlog.L1Cache), expected)
+	}
+	binlog.Log("Hello %d", 1)
+	binlog.Log("Hello %d", 2)
+	if statistics := binlog.GetStatistics(); statistics.L1CachePages != 1 || statistics.L1CacheHit != 1 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+	pages := 0
+	for _, page := range binlog.L1Cache {
+		if page != nil {
+			pages++
+		}
+	}
+	if pages != 1 {
+		t.Fatalf("%d pages instead of 1", pages)
+	}
+}
+
+func logFromCallSite(binlog *Binlog, i int) {
+	binlog.Log("Hello %d", i)
+}
+
+// Two calls share the format string, every call gets a handler
+func TestHandlerPerCallSite(t *testing.T) {
+	HANDLER_PER_CALL_SITE, ADD_SOURCE_LINE = true, true
+	defer func() { HANDLER_PER_CALL_SITE, ADD_SOURCE_LINE = false, false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	_, _, line, _ := runtime.Caller(0)
+	for i := 0; i < 3; i++ {
+		binlog.Log("Hello %d", i)
+		logFromCallSite(binlog, i)
+	}
+	statistics := binlog.GetStatistics()
+	if statistics.CallSiteMiss != 2 || statistics.CallSiteHit != 4 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+	handlers, _ := binlog.GetIndexTable()
+	if len(handlers) != 2 {
+		t.Fatalf("%d handlers instead of 2", len(handlers))
+	}
+	for _, h := range handlers {
+		if h.Count != 3 {
+			t.Fatalf("Handler %s count %d instead of 3", h.Args.fmtString, h.Count)
+		}
+	}
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), nil)
+	for i := 0; i < 6; i++ {
+		if !decoder.Next() {
+			t.Fatalf("Failed to decode %v", decoder.Err())
+		}
+		logEntry := decoder.Entry()
+		if expected := fmt.Sprintf("Hello %d", i/2); Format(logEntry) != expected {
+			t.Fatalf("Print failed expected '%s', actual '%s'", expected, Format(logEntry))
+		}
+		if i%2 == 0 && logEntry.LineNumber != line+2 {
+			t.Fatalf("Line number is %d instead of %d", logEntry.LineNumber, line+2)
+		}
+		if i%2 == 1 && logEntry.LineNumber == line+2 {
+			t.Fatalf("Line number of the second call is %d", logEntry.LineNumber)
+		}
+	}
+}
+
+// The same format string with different argument types
+func TestArgTypeVariants(t *testing.T) {
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	fmtString := "Value %d"
+	args := []interface{}{int8(-1), int64(1 << 40), int8(2), int64(3)}
+	for _, arg := range args {
+		if err := binlog.Log(fmtString, arg); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := binlog.Log(fmtString, "string"); err == nil {
+		t.Fatalf("No error for a string argument")
+	}
+	statistics := binlog.GetStatistics()
+	if statistics.ArgTypeMismatch != 3 || statistics.ArgTypeVariants != 1 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), nil)
+	for _, arg := range args {
+		if !decoder.Next() {
+			t.Fatalf("Failed to decode %v", decoder.Err())
+		}
+		if expected, actual := fmt.Sprintf(fmtString, arg), Format(decoder.Entry()); actual != expected {
+			t.Fatalf("Print failed expected '%s', actual '%s'", expected, actual)
+		}
+	}
+	if decoder.Next() {
+		t.Fatalf("Unexpected log entry '%s'", Format(decoder.Entry()))
+	}
+}
+
+// The decoder prints the missing and extra arguments like fmt.Sprintf()
+func TestMissingExtraArgs(t *testing.T) {
+	ADD_DICTIONARY = true
+	defer func() { ADD_DICTIONARY = false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	logs := []struct {
+		fmtString string
+		args      []interface{}
+	}{
+		{"Missing %d %d", []interface{}{1}},
+		{"Missing %d %d", []interface{}{}},
+		{"Missing %d %d", []interface{}{1, 2}},
+		{"Extra %d", []interface{}{1, "world", uint8(2)}},
+		{"Percent 100%% %d", []interface{}{3}},
+	}
+	for _, l := range logs {
+		if err := binlog.Log(l.fmtString, l.args...); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	// The dictionary records are in the binary stream
+	decoder := NewDecoder(&buf, nil, nil)
+	for _, l := range logs {
+		if !decoder.Next() {
+			t.Fatalf("Failed to decode %v", decoder.Err())
+		}
+		if expected, actual := fmt.Sprintf(l.fmtString, l.args...), Format(decoder.Entry()); actual != expected {
+			t.Fatalf("Print failed expected '%s', actual '%s'", expected, actual)
+		}
+	}
+	if err := binlog.Log("Extra %d", 1, 2.0); err == nil {
+		t.Fatalf("No error for an extra float")
+	}
+}
+
+// Strings longer than 64KB and the truncated strings
+func TestLongString(t *testing.T) {
+	ADD_FRAME_HEADER = true
+	defer func() { ADD_FRAME_HEADER = false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	long := strings.Repeat("a", 100<<10)
+	binlog.Log("Long %s %d", long, 1)
+	maxStringLength := MAX_STRING_LENGTH
+	MAX_STRING_LENGTH = 10
+	defer func() { MAX_STRING_LENGTH = maxStringLength }()
+	binlog.Log("Long %s %d", long, 2)
+	binlog.Log("Long %s %d", "0123456789", 3)
+
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), nil)
+	expected := []string{"Long " + long + " 1", "Long aaaaaaaaaa...[102390 bytes truncated] 2", "Long 0123456789 3"}
+	for _, e := range expected {
+		if !decoder.Next() {
+			t.Fatalf("Failed to decode %v", decoder.Err())
+		}
+		if actual := Format(decoder.Entry()); actual != e {
+			t.Fatalf("Print failed expected '%.100s', actual '%.100s'", e, actual)
+		}
+	}
+}
+
+// The strings share MAX_FRAME_SIZE, the short strings remain intact
+func TestLongStringFrame(t *testing.T) {
+	ADD_FRAME_HEADER = true
+	defer func() { ADD_FRAME_HEADER = false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	long := strings.Repeat("a", MAX_STRING_LENGTH)
+	if err := binlog.Log("Long %s %s %s %s", long, "short", long, long); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if size := buf.Len() - FRAME_HEADER_SIZE; size > MAX_FRAME_SIZE {
+		t.Fatalf("Frame size %d is larger than %d", size, MAX_FRAME_SIZE)
+	}
+	if statistics := binlog.GetStatistics(); statistics.FrameTruncated != 1 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), nil)
+	if !decoder.Next() {
+		t.Fatalf("Failed to decode %v", decoder.Err())
+	}
+	args := decoder.Entry().Args
+	if args[1] != "short" {
+		t.Fatalf("Unexpected short string '%v'", args[1])
+	}
+	for _, i := range []int{0, 2, 3} {
+		if s := args[i].(string); !strings.HasSuffix(s, " bytes truncated]") || len(s) > MAX_FRAME_SIZE/3 {
+			t.Fatalf("Unexpected long string '%.100s', %d bytes", s, len(s))
+		}
+	}
+
+	// A corrupted length of the string
+	decoder = NewDecoder(bytes.NewReader(binary.AppendUvarint(nil, (MAX_FRAME_SIZE+1)<<2|stringPlain)), nil, nil)
+	if _, err := decoder.readString(); !errors.Is(err, &ErrStringTooLong{}) {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+// MAX_STRING_LENGTH above MAX_FRAME_SIZE, Log() truncates the strings to
+// the length the decoder accepts
+func TestLongStringLimit(t *testing.T) {
+	maxStringLength := MAX_STRING_LENGTH
+	MAX_STRING_LENGTH = 2 * MAX_FRAME_SIZE
+	defer func() { MAX_STRING_LENGTH = maxStringLength }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	long := strings.Repeat("a", MAX_FRAME_SIZE+10)
+	binlog.Log("Long %s %d", long, 1)
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), nil)
+	if !decoder.Next() {
+		t.Fatalf("Failed to decode %v", decoder.Err())
+	}
+	if expected, actual := long[:MAX_FRAME_SIZE]+"...[10 bytes truncated]", decoder.Entry().Args[0]; actual != expected {
+		t.Fatalf("Print failed expected '%.100s', actual '%.100v'", expected, actual)
+	}
+}
+
+// Version 1 of the stream has 16 bits length of the strings
+func TestStringVersion1(t *testing.T) {
+	decoder := NewDecoder(bytes.NewReader([]byte{5, 0, 'H', 'e', 'l', 'l', 'o'}), nil, nil)
+	decoder.version = 1
+	if s, err := decoder.readString(); err != nil || s != "Hello" {
+		t.Fatalf("Failed to read '%s', %v", s, err)
+	}
+}
+
+func TestFrameResync(t *testing.T) {
+	ADD_FRAME_HEADER = true
+	defer func() { ADD_FRAME_HEADER = false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+
+	binlog.Log("Hello %d", 1)
+	frameSize := buf.Len()
+	binlog.Log("Hello %s", "world")
+	garbage := []byte{0xB1, 0x0C, 0x00}
+	buf.Write(garbage)
+	binlog.Log("Hello %d %d", 2, 3)
+	// Corrupt the hash of the second frame
+	buf.Bytes()[frameSize+FRAME_HEADER_SIZE] ^= 0xFF
+
+	logEntry, err := binlog.DecodeNext(&buf)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if actual := fmt.Sprintf(logEntry.FmtString, logEntry.Args...); actual != "Hello 1" {
+		t.Fatalf("Print failed expected '%s', actual '%s'", "Hello 1", actual)
+	}
+	_, err = binlog.DecodeNext(&buf)
+	var errFrameSkipped *ErrFrameSkipped
+	if !errors.As(err, &errFrameSkipped) {
+		t.Fatalf("Expected ErrFrameSkipped, got %v", err)
+	}
+	logEntry, err = binlog.DecodeNext(&buf)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if actual := fmt.Sprintf(logEntry.FmtString, logEntry.Args...); actual != "Hello 2 3" {
+		t.Fatalf("Print failed expected '%s', actual '%s'", "Hello 2 3", actual)
+	}
+	if logEntry.Skipped != len(garbage) {
+		t.Fatalf("Skipped %d bytes instead of %d", logEntry.Skipped, len(garbage))
+	}
+	if _, err = binlog.DecodeNext(&buf); err == nil {
+		t.Fatalf("Expected end of the stream")
+	}
+}
+
+func TestFrameCRC(t *testing.T) {
+	ADD_FRAME_CRC = true
+	defer func() { ADD_FRAME_CRC = false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+
+	binlog.Log("Hello %d", 1)
+	frameSize := buf.Len()
+	binlog.Log("Hello %d", 2)
+	binlog.Log("Hello %d", 3)
+	data := buf.Bytes()
+	// Flip a bit in the argument of the second frame
+	data[2*frameSize-5] ^= 0x01
+	// Truncate the last frame
+	reader := bytes.NewReader(data[:len(data)-1])
+
+	logEntry, err := binlog.DecodeNext(reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if actual := fmt.Sprintf(logEntry.FmtString, logEntry.Args...); actual != "Hello 1" {
+		t.Fatalf("Print failed expected '%s', actual '%s'", "Hello 1", actual)
+	}
+	var errCorruptedFrame *ErrCorruptedFrame
+	_, err = binlog.DecodeNext(reader)
+	if !errors.As(err, &errCorruptedFrame) {
+		t.Fatalf("Expected ErrCorruptedFrame, got %v", err)
+	}
+	if errCorruptedFrame.Offset != int64(frameSize) {
+		t.Fatalf("Offset is %d instead of %d", errCorruptedFrame.Offset, frameSize)
+	}
+	var errTruncated *ErrTruncated
+	_, err = binlog.DecodeNext(reader)
+	if !errors.As(err, &errTruncated) {
+		t.Fatalf("Expected ErrTruncated, got %v", err)
+	}
+	if errTruncated.Offset != int64(2*frameSize) {
+		t.Fatalf("Offset is %d instead of %d", errTruncated.Offset, 2*frameSize)
+	}
+}
+
+func TestFrameCRCResync(t *testing.T) {
+	ADD_FRAME_HEADER, ADD_FRAME_CRC = true, true
+	defer func() { ADD_FRAME_HEADER, ADD_FRAME_CRC = false, false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+
+	binlog.Log("Hello %d", 1)
+	frameSize := buf.Len()
+	binlog.Log("Hello %d", 2)
+	// Flip a bit in the argument of the first frame
+	buf.Bytes()[frameSize-5] ^= 0x01
+
+	var errFrameSkipped *ErrFrameSkipped
+	var errCorruptedFrame *ErrCorruptedFrame
+	_, err := binlog.DecodeNext(&buf)
+	if !errors.As(err, &errFrameSkipped) || !errors.As(err, &errCorruptedFrame) {
+		t.Fatalf("Expected ErrFrameSkipped and ErrCorruptedFrame, got %v", err)
+	}
+	logEntry, err := binlog.DecodeNext(&buf)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if actual := fmt.Sprintf(logEntry.FmtString, logEntry.Args...); actual != "Hello 2" {
+		t.Fatalf("Print failed expected '%s', actual '%s'", "Hello 2", actual)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+
+	binlog.Log("Hello %d", 1)
+	frameSize := buf.Len()
+	data := buf.Bytes()
+
+	_, err := binlog.DecodeNext(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = binlog.DecodeNext(bytes.NewReader(data[:0]))
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+	_, err = binlog.DecodeNext(bytes.NewReader(data[:frameSize-1]))
+	if !errors.Is(err, &ErrTruncated{}) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected ErrTruncated, got %v", err)
+	}
+	unknownHash := append([]byte{}, data...)
+	unknownHash[0] ^= 0xFF
+	_, err = binlog.DecodeNext(bytes.NewReader(unknownHash))
+	var errUnknownHash *ErrUnknownHash
+	if !errors.As(err, &errUnknownHash) {
+		t.Fatalf("Expected ErrUnknownHash, got %v", err)
+	}
+	if errUnknownHash.Hash != binary.LittleEndian.Uint32(unknownHash) {
+		t.Fatalf("Hash is %x instead of %x", errUnknownHash.Hash, binary.LittleEndian.Uint32(unknownHash))
+	}
+}
+
 func BenchmarkFmtFprintf3Ints(b *testing.B) {
 	var buf DummyIoWriter
 	buf.Grow(b.N * (8 + 4 + 4 + 8))
@@ -1118,3 +1571,320 @@ func BenchmarkTypeCast2(b *testing.B) {
 		count = count + *((*int)(data))
 	}
 }
+
+// The const string arguments are in the dictionary, the binary stream
+// contains the IDs of the strings
+func TestInternConstStrings(t *testing.T) {
+	INTERN_CONST_STRINGS = true
+	defer func() { INTERN_CONST_STRINGS = false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	state := "CONNECTION_ESTABLISHED"
+	dynamic := fmt.Sprintf("%s", "dynamic")
+	binlog.Log("State %s %s", state, dynamic)
+	size := buf.Len()
+	binlog.Log("State %s %s", state, dynamic)
+	if size2 := buf.Len() - size; size2 != 4+1+1+len(dynamic) {
+		t.Fatalf("Log entry size is %d", size2)
+	}
+	binlog.Log("State %s %s", state[:10], state)
+	statistics := binlog.GetStatistics()
+	if statistics.ConstStringMiss != 2 || statistics.ConstStringHit != 2 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+	// The string arguments do not affect the statistics of the format strings
+	INTERN_CONST_STRINGS = false
+	plain := New(Config{io.Discard, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	plain.Log("State %s %s", state, dynamic)
+	plain.Log("State %s %s", state, dynamic)
+	plain.Log("State %s %s", state[:10], state)
+	INTERN_CONST_STRINGS = true
+	if expected := plain.GetStatistics(); statistics.StringOffsetOk != expected.StringOffsetOk || statistics.StringOOM != expected.StringOOM {
+		t.Fatalf("Unexpected statistics %+v, expected %+v", statistics, expected)
+	}
+
+	// The decoder gets the strings from the dictionary
+	var dictionary bytes.Buffer
+	binlog.WriteDictionary(&dictionary)
+	decoder := NewDecoder(io.MultiReader(&dictionary, &buf), nil, nil)
+	expected := []string{"State CONNECTION_ESTABLISHED dynamic", "State CONNECTION_ESTABLISHED dynamic", "State CONNECTION CONNECTION_ESTABLISHED"}
+	for _, e := range expected {
+		if !decoder.Next() {
+			t.Fatalf("Failed to decode %v", decoder.Err())
+		}
+		if actual := Format(decoder.Entry()); actual != e {
+			t.Fatalf("Print failed expected '%s', actual '%s'", e, actual)
+		}
+	}
+}
+
+// With ADD_DICTIONARY the string records precede the first log entry which
+// uses the strings
+func TestInternConstStringsDictionary(t *testing.T) {
+	INTERN_CONST_STRINGS, ADD_DICTIONARY, ADD_FRAME_HEADER = true, true, true
+	defer func() { INTERN_CONST_STRINGS, ADD_DICTIONARY, ADD_FRAME_HEADER = false, false, false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	binlog.Log("State %s", "IDLE")
+	binlog.Log("State %s", "RUNNING")
+	binlog.Log("State %s", "IDLE")
+	decoder := NewDecoder(&buf, nil, nil)
+	for _, e := range []string{"State IDLE", "State RUNNING", "State IDLE"} {
+		if !decoder.Next() {
+			t.Fatalf("Failed to decode %v", decoder.Err())
+		}
+		if actual := Format(decoder.Entry()); actual != e {
+			t.Fatalf("Print failed expected '%s', actual '%s'", e, actual)
+		}
+	}
+}
+
+// DecodeNext() does not keep the intern table, the second call fails
+func TestInternTableDecodeNext(t *testing.T) {
+	INTERN_TABLE_SIZE = 4
+	defer func() { INTERN_TABLE_SIZE = 0 }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	path := fmt.Sprintf("/api/%s", "users")
+	binlog.Log("GET %s", path)
+	binlog.Log("GET %s", path)
+	logEntry, err := binlog.DecodeNext(&buf)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if actual := fmt.Sprintf(logEntry.FmtString, logEntry.Args...); actual != "GET /api/users" {
+		t.Fatalf("Print failed expected '%s', actual '%s'", "GET /api/users", actual)
+	}
+	if _, err = binlog.DecodeNext(&buf); !errors.Is(err, &ErrNoInternTable{}) {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+// The runtime strings are defined in the stream and sent as slots after
+// the first use
+func TestInternTable(t *testing.T) {
+	INTERN_TABLE_SIZE, ADD_FRAME_HEADER, ADD_FRAME_CRC = 2, true, true
+	defer func() { INTERN_TABLE_SIZE, ADD_FRAME_HEADER, ADD_FRAME_CRC = 0, false, false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	paths := []string{"/api/users", "/api/users", "/api/orders", "/api/users", "/api/items", "/api/orders", "/"}
+	sizes := []int{}
+	for _, path := range paths {
+		size := buf.Len()
+		binlog.Log("GET %s", fmt.Sprintf("%s", path))
+		sizes = append(sizes, buf.Len()-size)
+	}
+	// The hash, the slot, the frame header and the CRC
+	if sizes[1] != 4+1+FRAME_HEADER_SIZE+4 || sizes[3] != sizes[1] {
+		t.Fatalf("Log entry sizes are %v", sizes)
+	}
+	statistics := binlog.GetStatistics()
+	// "/api/items" evicts "/api/orders", "/" is too short
+	if statistics.InternHit != 2 || statistics.InternMiss != 4 || statistics.InternEvicted != 2 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+
+	stream := buf.Bytes()
+	var dictionary bytes.Buffer
+	binlog.WriteDictionary(&dictionary)
+	decoder := NewDecoder(io.MultiReader(&dictionary, bytes.NewReader(stream)), nil, nil)
+	for _, path := range paths {
+		if !decoder.Next() {
+			t.Fatalf("Failed to decode %v", decoder.Err())
+		}
+		if actual := Format(decoder.Entry()); actual != "GET "+path {
+			t.Fatalf("Print failed expected '%s', actual '%s'", "GET "+path, actual)
+		}
+	}
+	if decoder.Next() || decoder.Err() != nil {
+		t.Fatalf("Unexpected end of the stream %v", decoder.Err())
+	}
+
+	// A decoder which missed the define records
+	decoder = NewDecoder(bytes.NewReader(stream[sizes[0]:]), binlog.GetDictionary(), nil)
+	if decoder.Next() || !errors.Is(decoder.Err(), &ErrUnknownString{}) {
+		t.Fatalf("Unexpected error %v", decoder.Err())
+	}
+}
+
+// A log entry does not evict the strings it refers to
+func TestInternTableFull(t *testing.T) {
+	INTERN_TABLE_SIZE = 1
+	defer func() { INTERN_TABLE_SIZE = 0 }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	host, tenant := fmt.Sprintf("%s", "example.com"), fmt.Sprintf("%s", "tenant1")
+	binlog.Log("%s %s", host, tenant)
+	binlog.Log("%s %s", tenant, host)
+	statistics := binlog.GetStatistics()
+	if statistics.InternMiss != 2 || statistics.InternEvicted != 1 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), nil)
+	for _, e := range []string{"example.com tenant1", "tenant1 example.com"} {
+		if !decoder.Next() {
+			t.Fatalf("Failed to decode %v", decoder.Err())
+		}
+		if actual := Format(decoder.Entry()); actual != e {
+			t.Fatalf("Print failed expected '%s', actual '%s'", e, actual)
+		}
+	}
+}
+
+// The decoder missed the frame which reused the slot. After the reset the
+// decoder gets the new string, not the previous string of the slot
+func TestInternTableReset(t *testing.T) {
+	INTERN_TABLE_SIZE = 1
+	defer func() { INTERN_TABLE_SIZE = 0 }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	first, second := fmt.Sprintf("%s", "/first"), fmt.Sprintf("%s", "/second")
+	binlog.Log("Path %s", first)
+	size := buf.Len()
+	binlog.Log("Path %s", second)
+	// The sink drops the frame
+	buf.Truncate(size)
+	binlog.ResetInternTable()
+	binlog.Log("Path %s", second)
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), nil)
+	for _, e := range []string{"Path /first", "Path /second"} {
+		if !decoder.Next() {
+			t.Fatalf("Failed to decode %v", decoder.Err())
+		}
+		if actual := Format(decoder.Entry()); actual != e {
+			t.Fatalf("Print failed expected '%s', actual '%s'", e, actual)
+		}
+	}
+	if statistics := binlog.GetStatistics(); statistics.InternMiss != 3 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+}
+
+// The L1 and the L2 handlers of the same format string share the hash, the
+// eviction of the L2 handler keeps the hash in the dictionary
+func TestL2CacheEvictionSharedHash(t *testing.T) {
+	L2_CACHE_SIZE = 1
+	defer func() { L2_CACHE_SIZE = 0 }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	literal := "Shared %d"
+	binlog.Log(literal, 1)
+	binlog.Log(strings.Clone(literal), 2)
+	binlog.Log(fmt.Sprintf("Dynamic %s", "%d"), 3)
+	if statistics := binlog.GetStatistics(); statistics.L2CacheEvicted != 1 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), nil)
+	for _, e := range []string{"Shared 1", "Shared 2", "Dynamic 3"} {
+		if !decoder.Next() {
+			t.Fatalf("Failed to decode %v", decoder.Err())
+		}
+		if actual := Format(decoder.Entry()); actual != e {
+			t.Fatalf("Print failed expected '%s', actual '%s'", e, actual)
+		}
+	}
+}
+
+// The full L2 cache evicts the least recently used format string
+func TestL2CacheEviction(t *testing.T) {
+	L2_CACHE_SIZE, ADD_DICTIONARY = 2, true
+	defer func() { L2_CACHE_SIZE, ADD_DICTIONARY = 0, false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	fmtStrings := []string{}
+	for i := 0; i < 3; i++ {
+		fmtStrings = append(fmtStrings, fmt.Sprintf("Request %d %%d", i))
+	}
+	expected := []string{}
+	for _, i := range []int{0, 1, 0, 2, 1} {
+		binlog.Log(fmtStrings[i], i)
+		expected = append(expected, fmt.Sprintf(fmtStrings[i], i))
+	}
+	statistics := binlog.GetStatistics()
+	// "Request 2" evicts "Request 1", "Request 1" evicts "Request 0"
+	if statistics.L2CacheEvicted != 2 || statistics.L2CacheMiss != 4 || statistics.L2CacheHit != 1 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+	if len(binlog.L2Cache) != 2 || len(binlog.GetDictionary().Handlers) != 2 {
+		t.Fatalf("%d handlers in the L2 cache, %d in the dictionary", len(binlog.L2Cache), len(binlog.GetDictionary().Handlers))
+	}
+	// The dictionary records in the stream contain the evicted format strings
+	decoder := NewDecoder(&buf, nil, nil)
+	for _, e := range expected {
+		if !decoder.Next() {
+			t.Fatalf("Failed to decode %v", decoder.Err())
+		}
+		if actual := Format(decoder.Entry()); actual != e {
+			t.Fatalf("Print failed expected '%s', actual '%s'", e, actual)
+		}
+	}
+}
+
+// The full L2 cache keeps the handlers, new format strings are rendered as text
+func TestL2CacheRenderText(t *testing.T) {
+	L2_CACHE_SIZE, L2_CACHE_RENDER_TEXT = 1, true
+	defer func() { L2_CACHE_SIZE, L2_CACHE_RENDER_TEXT = 0, false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	cached := fmt.Sprintf("%s %%d", "Cached")
+	binlog.Log(cached, 1)
+	binlog.Log(fmt.Sprintf("%s %%d %%s", "Rendered"), 2, "text")
+	binlog.Log(fmt.Sprintf("%s %%v", "Rendered"), 3)
+	binlog.Log(cached, 4)
+	statistics := binlog.GetStatistics()
+	if statistics.L2CacheEvicted != 0 || statistics.L2CacheRendered != 2 || statistics.L2CacheHit != 1 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+	if len(binlog.GetDictionary().Handlers) != 2 {
+		t.Fatalf("%d handlers in the dictionary", len(binlog.GetDictionary().Handlers))
+	}
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), nil)
+	for _, e := range []string{"Cached 1", "Rendered 2 text", "Rendered 3", "Cached 4"} {
+		if !decoder.Next() {
+			t.Fatalf("Failed to decode %v", decoder.Err())
+		}
+		if actual := Format(decoder.Entry()); actual != e {
+			t.Fatalf("Print failed expected '%s', actual '%s'", e, actual)
+		}
+	}
+}
+
+// Two format strings with the same 32 bits hash get different hashes
+func TestHashCollision(t *testing.T) {
+	fmtString1, fmtString2 := "Request %d took %d ms 866809", "Request %d took %d ms 1287504"
+	if hashString(fmtString1, 0) != hashString(fmtString2, 0) {
+		t.Fatalf("Hashes of '%s' and '%s' are different", fmtString1, fmtString2)
+	}
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, nanotime.Now})
+	binlog.Log(fmtString1, 1, 10)
+	binlog.Log(fmtString2, 2, 20)
+	// The same format string in the L2 cache shares the hash
+	binlog.Log(fmt.Sprintf("%s", fmtString1), 3, 30)
+	statistics := binlog.GetStatistics()
+	if statistics.HashCollision != 1 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+	if len(binlog.GetDictionary().Handlers) != 2 {
+		t.Fatalf("%d handlers in the dictionary", len(binlog.GetDictionary().Handlers))
+	}
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), nil)
+	for _, e := range []string{"Request 1 took 10 ms 866809", "Request 2 took 20 ms 1287504", "Request 3 took 30 ms 866809"} {
+		if !decoder.Next() {
+			t.Fatalf("Failed to decode %v", decoder.Err())
+		}
+		if actual := Format(decoder.Entry()); actual != e {
+			t.Fatalf("Print failed expected '%s', actual '%s'", e, actual)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// binlogd collects binary logs sent by NetworkSink
+//
+//	binlogd -listen tcp:0.0.0.0:7070 -listen unix:/var/run/binlog.sock -directory /var/log/binlog -format json
+//
+// Every source, the process ID, the executable, the build ID and the
+// instance of the logger, gets the file <executable>-<pid>-<buildid>-<instance>.binlog. With -format binlogd writes the
+// decoded log entries to .log, .jsonl or .logfmt files next to the binary
+// logs. Decode the binary logs with binlogdecode
+package main
+
+import (
+	"binlog"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+type listenFlags []string
+
+func (l *listenFlags) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listenFlags) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func main() {
+	var addresses listenFlags
+	flag.Var(&addresses, "listen", "network:address, for example, tcp:0.0.0.0:7070 or unix:/var/run/binlog.sock, can repeat")
+	directory := flag.String("directory", ".", "directory for the collected logs")
+	format := flag.String("format", "", "decode the logs to text, json or logfmt, by default only the binary logs")
+	flag.Parse()
+	if len(addresses) == 0 {
+		addresses = listenFlags{"tcp:0.0.0.0:7070"}
+	}
+
+	collector, err := binlog.NewCollector(binlog.CollectorConfig{Directory: *directory, Format: *format})
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	listeners := []net.Listener{}
+	for _, address := range addresses {
+		fields := strings.SplitN(address, ":", 2)
+		if len(fields) != 2 {
+			log.Fatalf("Bad listen address '%s', expected network:address", address)
+		}
+		if fields[0] == "unix" {
+			os.Remove(fields[1])
+		}
+		listener, err := net.Listen(fields[0], fields[1])
+		if err != nil {
+			log.Fatalf("Failed to listen %v", err)
+		}
+		listeners = append(listeners, listener)
+		go collector.Serve(listener)
+	}
+
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
+	<-signalChannel
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	// The collector does not buffer the files, the frames are in the files
+	// when the connections close
+	collector.Close()
+	collector.Wait()
+	statistics := collector.GetStatistics()
+	log.Printf("Connections %d, sources %d, errors %d, write errors %d", statistics.Connections, statistics.Sources, statistics.Errors, statistics.WriteErrors)
+}
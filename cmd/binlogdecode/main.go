@@ -0,0 +1,154 @@
+// binlogdecode converts binary logs to text, JSON Lines or logfmt
+//
+//	binlogdecode -dictionary app.dict -format json app.binlog > app.jsonl
+//
+// The dictionary is the output of Binlog.WriteDictionary(). If the binary
+// log contains the dictionary records, for example, ADD_DICTIONARY or the
+// panic hook, the dictionary file is not required
+// Without arguments binlogdecode reads the binary log from stdin
+// With -follow binlogdecode waits for new log entries, the logger shall set
+// ADD_DICTIONARY or the application shall provide the dictionary
+package main
+
+import (
+	"binlog"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+func main() {
+	dictionaryFilename := flag.String("dictionary", "", "dictionary file written by Binlog.WriteDictionary()")
+	format := flag.String("format", "text", "output format: text, json or logfmt")
+	stopOnError := flag.Bool("stop-on-error", false, "exit on the first decoding error")
+	follow := flag.Bool("follow", false, "wait for new log entries like tail -f, requires one file")
+	flag.Parse()
+
+	dictionary := binlog.NewDictionary()
+	var options *binlog.DecoderOptions
+	if *dictionaryFilename != "" {
+		file, err := os.Open(*dictionaryFilename)
+		if err != nil {
+			log.Fatalf("Failed to open dictionary %v", err)
+		}
+		dictionary, options, err = binlog.ReadDictionary(file)
+		file.Close()
+		if err != nil {
+			log.Fatalf("Failed to read dictionary %s: %v", *dictionaryFilename, err)
+		}
+	}
+
+	output := bufio.NewWriter(os.Stdout)
+	defer output.Flush()
+	var encoder binlog.EntryEncoder
+	switch *format {
+	case "text":
+		encoder = binlog.NewTextEncoder(output)
+	case "json":
+		encoder = binlog.NewJSONEncoder(output)
+	case "logfmt":
+		encoder = binlog.NewLogfmtEncoder(output)
+	default:
+		log.Fatalf("Unknown format '%s'", *format)
+	}
+
+	filenames := flag.Args()
+	if *follow {
+		if len(filenames) != 1 {
+			log.Fatalf("Follow mode requires exactly one file")
+		}
+		if err := followFile(filenames[0], dictionary, options, encoder, output, *stopOnError); err != nil {
+			output.Flush()
+			log.Fatalf("Failed to decode %s: %v", filenames[0], err)
+		}
+		return
+	}
+	if len(filenames) == 0 {
+		filenames = []string{"-"}
+	}
+	for _, filename := range filenames {
+		var reader io.Reader = os.Stdin
+		if filename != "-" {
+			file, err := os.Open(filename)
+			if err != nil {
+				log.Fatalf("Failed to open %v", err)
+			}
+			defer file.Close()
+			reader = file
+		}
+		fileDictionary, fileOptions := dictionary, options
+		if *dictionaryFilename == "" && filename != "-" {
+			fileDictionary, fileOptions = scanDictionary(reader.(*os.File), dictionary, options)
+		}
+		if err := decode(reader, fileDictionary, fileOptions, encoder, *stopOnError); err != nil {
+			output.Flush()
+			log.Fatalf("Failed to decode %s: %v", filename, err)
+		}
+	}
+}
+
+// The dictionary can be anywhere in the file, for example, the panic hook
+// writes the dictionary in the end of the file. If the scan fails I decode
+// with the dictionary records which precede the log entries
+func scanDictionary(file *os.File, dictionary *binlog.Dictionary, options *binlog.DecoderOptions) (*binlog.Dictionary, *binlog.DecoderOptions) {
+	scannedDictionary, scannedOptions, err := binlog.ScanDictionary(file, options)
+	if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+		log.Fatalf("Failed to seek %v", seekErr)
+	}
+	if err != nil {
+		return dictionary, options
+	}
+	return scannedDictionary, scannedOptions
+}
+
+// If the binary log has frame headers the decoder skips the broken frames,
+// the errors go to stderr
+func decode(reader io.Reader, dictionary *binlog.Dictionary, options *binlog.DecoderOptions, encoder binlog.EntryEncoder, stopOnError bool) error {
+	decoder := binlog.NewDecoder(reader, dictionary, options)
+	for {
+		for decoder.Next() {
+			if err := encoder.Encode(decoder.Entry()); err != nil {
+				return err
+			}
+		}
+		err := decoder.Err()
+		if err == nil {
+			return nil
+		}
+		if !isSkipped(err) || stopOnError {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+// Flush the output after every log entry, the user is watching
+func followFile(filename string, dictionary *binlog.Dictionary, options *binlog.DecoderOptions, encoder binlog.EntryEncoder, output *bufio.Writer, stopOnError bool) error {
+	follower, err := binlog.NewFollower(filename, dictionary, options)
+	if err != nil {
+		return err
+	}
+	defer follower.Close()
+	for {
+		for follower.Next() {
+			if err := encoder.Encode(follower.Entry()); err != nil {
+				return err
+			}
+			output.Flush()
+		}
+		err := follower.Err()
+		if err == nil || !isSkipped(err) || stopOnError {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+// The decoder can continue after these errors
+func isSkipped(err error) bool {
+	return errors.Is(err, &binlog.ErrFrameSkipped{}) || errors.Is(err, &binlog.ErrCorruptedFrame{})
+}
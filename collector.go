@@ -0,0 +1,299 @@
+package binlog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type CollectorConfig struct {
+	Directory string // the collector writes <source>.binlog files to the directory
+	Format    string // "text", "json" or "logfmt" adds <source>.log, .jsonl or .logfmt files, "" - no decoding
+}
+
+// Collector receives binary streams from many sources, for example,
+// NetworkSink, and stores every source in a separate file
+// The collector keeps a dictionary for every source. A source is the process
+// ID, the executable, the build ID and the instance of the logger from the
+// stream header. The
+// connections of the same source append to the same file, a reconnecting
+// source can skip the dictionary. If two connections of the same source are
+// active at the same time the second connection gets separate files
+type Collector struct {
+	config     CollectorConfig
+	mutex      sync.Mutex
+	sources    map[string]*collectorSource
+	statistics CollectorStatistics
+
+	connectionID uint64
+	connections  sync.WaitGroup
+	active       map[uint64]io.Closer // the open connections for Close()
+}
+
+type CollectorStatistics struct {
+	Connections uint64
+	Sources     uint64
+	Errors      uint64 // frames the collector failed to decode
+	WriteErrors uint64 // log entries the collector failed to write to the decoded files
+}
+
+type collectorSource struct {
+	active     bool
+	dictionary *Dictionary
+}
+
+var collectorExtensions = map[string]string{"text": ".log", "json": ".jsonl", "logfmt": ".logfmt"}
+
+func NewCollector(config CollectorConfig) (*Collector, error) {
+	if _, ok := collectorExtensions[config.Format]; config.Format != "" && !ok {
+		return nil, fmt.Errorf("Unknown format '%s'", config.Format)
+	}
+	return &Collector{config: config, sources: make(map[string]*collectorSource), active: make(map[uint64]io.Closer)}, nil
+}
+
+// Serve handles the connections until the listener is closed
+func (c *Collector) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		c.connections.Add(1)
+		go func() {
+			defer c.connections.Done()
+			c.HandleConnection(conn)
+		}()
+	}
+}
+
+// Wait waits for the connections to close
+func (c *Collector) Wait() {
+	c.connections.Wait()
+}
+
+// Close closes the open connections. The collector stores the frames it
+// received, the sources reconnect to another collector. Close the listeners
+// before Close()
+func (c *Collector) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, conn := range c.active {
+		conn.Close()
+	}
+	return nil
+}
+
+func (c *Collector) GetStatistics() CollectorStatistics {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.statistics
+}
+
+// collectorConnection is the state of one binary stream
+// Until the collector knows the source the binary stream is in the buffer
+type collectorConnection struct {
+	buffer     bytes.Buffer
+	file       *os.File // the binary stream
+	output     *os.File // decoded log entries
+	encoder    EntryEncoder
+	name       string
+	source     *collectorSource
+	dictionary *Dictionary
+}
+
+func (cc *collectorConnection) Write(data []byte) (int, error) {
+	if cc.file == nil {
+		return cc.buffer.Write(data)
+	}
+	return cc.file.Write(data)
+}
+
+// HandleConnection reads the binary stream until the end of the stream
+// The collector stores the whole binary stream even if the collector fails
+// to decode the stream
+func (c *Collector) HandleConnection(conn io.ReadCloser) error {
+	defer conn.Close()
+	connectionID := atomic.AddUint64(&c.connectionID, 1)
+	c.mutex.Lock()
+	c.statistics.Connections++
+	c.active[connectionID] = conn
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.active, connectionID)
+		c.mutex.Unlock()
+	}()
+
+	cc := &collectorConnection{dictionary: NewDictionary()}
+	reader := io.TeeReader(conn, cc)
+	decoder := NewDecoder(reader, cc.dictionary, &DecoderOptions{})
+	attached := false
+	var err error
+	for {
+		ok := decoder.Next()
+		if !attached {
+			if !ok && decoder.Err() == nil && cc.buffer.Len() == 0 {
+				// An empty connection, for example, a health check
+				break
+			}
+			attached = true
+			if err = c.attach(cc, decoder.Properties(), connectionID); err != nil {
+				break
+			}
+		}
+		if ok {
+			if cc.encoder != nil {
+				if err := cc.encoder.Encode(decoder.Entry()); err != nil {
+					c.mutex.Lock()
+					c.statistics.WriteErrors++
+					c.mutex.Unlock()
+				}
+			}
+			continue
+		}
+		// Close() closes the connection in the middle of the stream
+		err = decoder.Err()
+		if err == nil || errors.Is(err, &ErrTruncated{}) || errors.Is(err, net.ErrClosed) {
+			err = nil
+			break
+		}
+		c.mutex.Lock()
+		c.statistics.Errors++
+		c.mutex.Unlock()
+		if !errors.Is(err, &ErrFrameSkipped{}) && !errors.Is(err, &ErrCorruptedFrame{}) {
+			break
+		}
+	}
+	// Store the rest of the binary stream
+	if attached && cc.file != nil {
+		io.Copy(io.Discard, reader)
+	}
+	c.detach(cc)
+	return err
+}
+
+// Find the source, open the files, write the buffered stream
+func (c *Collector) attach(cc *collectorConnection, properties map[string]string, connectionID uint64) error {
+	c.mutex.Lock()
+	name := getSourceName(properties)
+	if name == "" {
+		name = fmt.Sprintf("unknown-%d", connectionID)
+	}
+	source, ok := c.sources[name]
+	if !ok {
+		source = &collectorSource{dictionary: NewDictionary()}
+		c.sources[name] = source
+		c.statistics.Sources++
+	}
+	if source.active {
+		name = fmt.Sprintf("%s-%d", name, connectionID)
+	} else {
+		source.active = true
+		cc.source = source
+		// The stream can skip the dictionary records the source sent before
+		for hash, h := range source.dictionary.Handlers {
+			if _, ok := cc.dictionary.Handlers[hash]; !ok {
+				cc.dictionary.Handlers[hash] = h
+			}
+		}
+		for hash, filename := range source.dictionary.Filenames {
+			if _, ok := cc.dictionary.Filenames[hash]; !ok {
+				cc.dictionary.Filenames[hash] = filename
+			}
+		}
+		for id, s := range source.dictionary.Strings {
+			if _, ok := cc.dictionary.Strings[id]; !ok {
+				cc.dictionary.Strings[id] = s
+			}
+		}
+	}
+	c.mutex.Unlock()
+
+	cc.name = name
+	file, err := os.OpenFile(filepath.Join(c.config.Directory, name+".binlog"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(cc.buffer.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	cc.file = file
+	cc.buffer = bytes.Buffer{}
+	if c.config.Format == "" {
+		return nil
+	}
+	output, err := os.OpenFile(filepath.Join(c.config.Directory, name+collectorExtensions[c.config.Format]), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	cc.output = output
+	switch c.config.Format {
+	case "text":
+		cc.encoder = NewTextEncoder(output)
+	case "json":
+		cc.encoder = NewJSONEncoder(output)
+	case "logfmt":
+		cc.encoder = NewLogfmtEncoder(output)
+	}
+	return nil
+}
+
+// Keep the dictionary of the connection for the next connections
+func (c *Collector) detach(cc *collectorConnection) {
+	if cc.file != nil {
+		cc.file.Close()
+	}
+	if cc.output != nil {
+		cc.output.Close()
+	}
+	if cc.source == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for hash, h := range cc.dictionary.Handlers {
+		cc.source.dictionary.Handlers[hash] = h
+	}
+	for hash, filename := range cc.dictionary.Filenames {
+		cc.source.dictionary.Filenames[hash] = filename
+	}
+	for id, s := range cc.dictionary.Strings {
+		cc.source.dictionary.Strings[id] = s
+	}
+	cc.source.active = false
+}
+
+// Returns executable-pid-buildid-instance, "" if the stream header does not
+// have the process ID
+func getSourceName(properties map[string]string) string {
+	pid, ok := properties[PROPERTY_PID]
+	if !ok {
+		return ""
+	}
+	fields := []string{properties[PROPERTY_EXECUTABLE], pid}
+	if buildID := properties[PROPERTY_BUILD_ID]; buildID != "" {
+		// The Go build ID is "actionID/contentID", I need only a short prefix
+		if len(buildID) > 8 {
+			buildID = buildID[:8]
+		}
+		fields = append(fields, buildID)
+	}
+	if instance := properties[PROPERTY_INSTANCE]; instance != "" {
+		fields = append(fields, instance)
+	}
+	name := strings.Join(fields, "-")
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
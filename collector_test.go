@@ -0,0 +1,146 @@
+package binlog
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Log from a source with the given process ID and close the sink. Close()
+// sends the pending frames. The loggers of the same process ID are the same
+// source
+func sendToCollector(t *testing.T, address string, pid string, message string, count int) {
+	sink := NewNetworkSink(NetworkSinkConfig{Network: "tcp", Address: address,
+		FlushInterval: time.Millisecond, ReconnectInterval: time.Millisecond})
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: sink, WriterControl: sink, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	binlog.SetProperty(PROPERTY_PID, pid)
+	binlog.SetProperty(PROPERTY_INSTANCE, "1")
+	sink.SetDictionary(binlog)
+	for i := 0; i < count; i++ {
+		binlog.Log(message, i)
+	}
+	for sink.GetStatistics().Connects == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	sink.Close()
+}
+
+func readLines(t *testing.T, filename string) []string {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer file.Close()
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func TestCollector(t *testing.T) {
+	directory := t.TempDir()
+	collector, err := NewCollector(CollectorConfig{Directory: directory, Format: "text"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go collector.Serve(listener)
+
+	address := listener.Addr().String()
+	done := make(chan struct{})
+	go func() {
+		sendToCollector(t, address, "1", "First %d", 100)
+		close(done)
+	}()
+	sendToCollector(t, address, "2", "Second %d", 100)
+	<-done
+	// The second connection of the same source appends to the same file
+	sendToCollector(t, address, "1", "First %d", 10)
+	listener.Close()
+	collector.Wait()
+
+	if statistics := collector.GetStatistics(); statistics.Connections != 3 || statistics.Sources != 2 || statistics.Errors != 0 {
+		t.Fatalf("Unexpected statistics %v", statistics)
+	}
+	for pid, expected := range map[string]int{"1": 110, "2": 100} {
+		name := getSourceName(map[string]string{PROPERTY_PID: pid, PROPERTY_EXECUTABLE: getDefaultProperties()[PROPERTY_EXECUTABLE],
+			PROPERTY_BUILD_ID: getDefaultProperties()[PROPERTY_BUILD_ID], PROPERTY_INSTANCE: "1"})
+		lines := readLines(t, filepath.Join(directory, name+".log"))
+		if len(lines) != expected {
+			t.Fatalf("Source %s expected %d logs, actual %d", pid, expected, len(lines))
+		}
+
+		file, err := os.Open(filepath.Join(directory, name+".binlog"))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		decoder := NewDecoder(file, nil, &DecoderOptions{})
+		count := 0
+		for decoder.Next() {
+			if log := Format(decoder.Entry()); log != lines[count] {
+				t.Fatalf("Expected '%s', actual '%s'", lines[count], log)
+			}
+			count++
+		}
+		file.Close()
+		if count != expected {
+			t.Fatalf("Source %s expected %d binary logs, actual %d, %v", pid, expected, count, decoder.Err())
+		}
+	}
+}
+
+func TestCollectorSourceName(t *testing.T) {
+	name := getSourceName(map[string]string{PROPERTY_PID: "42", PROPERTY_EXECUTABLE: "my app", PROPERTY_BUILD_ID: "abc/def/ghi", PROPERTY_INSTANCE: "2"})
+	if name != "my_app-42-abc_def_-2" {
+		t.Fatalf("Unexpected name '%s'", name)
+	}
+	// Two loggers of the same process are different sources
+	first, second := New(Config{}), New(Config{})
+	if getSourceName(first.properties) == getSourceName(second.properties) {
+		t.Fatalf("The loggers have the same source name '%s'", getSourceName(first.properties))
+	}
+	if name := getSourceName(map[string]string{}); name != "" {
+		t.Fatalf("Unexpected name '%s'", name)
+	}
+	if strings.Contains(getSourceName(map[string]string{PROPERTY_PID: "../1"}), "/") {
+		t.Fatalf("Path separator in the source name")
+	}
+}
+
+// Close() ends the connections of the sources which are still logging
+func TestCollectorClose(t *testing.T) {
+	collector, err := NewCollector(CollectorConfig{Directory: t.TempDir()})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go collector.Serve(listener)
+	sink := NewNetworkSink(NetworkSinkConfig{Network: "tcp", Address: listener.Addr().String(), FlushInterval: time.Millisecond})
+	defer sink.Close()
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: sink, WriterControl: sink, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	sink.SetDictionary(binlog)
+	binlog.Log("Hello %d", 1)
+	for collector.GetStatistics().Sources == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	listener.Close()
+	collector.Close()
+	collector.Wait()
+	if statistics := collector.GetStatistics(); statistics.Errors != 0 || statistics.WriteErrors != 0 {
+		t.Fatalf("Unexpected statistics %v", statistics)
+	}
+}
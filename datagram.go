@@ -0,0 +1,357 @@
+package binlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Every datagram starts with 4 bytes sequence number
+const DATAGRAM_HEADER_SIZE = 4
+
+type DatagramSinkConfig struct {
+	Network            string        // "udp" or "unixgram"
+	Address            string        // for example, "collector:7070" or "/var/run/binlog.sock"
+	MaxDatagramSize    int           // the sink drops larger frames, 65507 bytes (UDP limit) by default
+	DictionaryInterval time.Duration // send the dictionary at least every DictionaryInterval, 1s by default
+	WriteTimeout       time.Duration // a full unixgram socket blocks the logger, 10ms by default
+}
+
+// DatagramSink sends every frame as one datagram. Nobody waits for the
+// datagram, the receiver can lose datagrams and join at any time
+// The datagram is the sequence number followed by the frame. The receiver
+// counts the gaps in the sequence numbers, see DatagramReceiver
+// A goroutine sends the dictionary every DictionaryInterval. If
+// ADD_DICTIONARY is not set the logger sends the dictionary before the
+// frame with a new format string. The dictionary records can span many
+// datagrams, every datagram contains complete records
+// DatagramSink is both the IOWriter and the WriterControl of the logger:
+//
+//	sink := NewDatagramSink(DatagramSinkConfig{Network: "udp", Address: "collector:7070"})
+//	binlog := New(Config{IOWriter: sink, WriterControl: sink, ...})
+//	sink.SetDictionary(binlog)
+type DatagramSink struct {
+	config   DatagramSinkConfig
+	mutex    sync.Mutex
+	conn     net.Conn
+	lastDial time.Time
+	frame    []byte // the sequence number and the current frame
+	sequence uint32
+
+	dictionary        DictionaryWriter
+	dictionaryVersion uint64
+
+	statistics DatagramSinkStatistics
+	done       chan struct{}
+	stopped    sync.WaitGroup
+	closeOnce  sync.Once
+}
+
+type DatagramSinkStatistics struct {
+	Datagrams uint64 // datagrams sent, including the dictionaries
+	Dropped   uint64 // frames larger than MaxDatagramSize and failed writes
+	Errors    uint64 // failed connection attempts and dictionaries
+}
+
+// NewDatagramSink starts the goroutine sending the dictionary
+// NewDatagramSink does not fail if there is no receiver, the sink
+// connects when the logger sends the first frame
+func NewDatagramSink(config DatagramSinkConfig) *DatagramSink {
+	if config.MaxDatagramSize <= 0 {
+		config.MaxDatagramSize = 65507
+	}
+	if config.DictionaryInterval <= 0 {
+		config.DictionaryInterval = time.Second
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = 10 * time.Millisecond
+	}
+	s := &DatagramSink{config: config, done: make(chan struct{})}
+	s.stopped.Add(1)
+	go s.run()
+	return s
+}
+
+// The dictionary is large, the logger does not wait for the periodic
+// dictionary. The goroutine holds the lock of the logger while the
+// dictionary writes
+func (s *DatagramSink) run() {
+	defer s.stopped.Done()
+	ticker := time.NewTicker(s.config.DictionaryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		s.mutex.Lock()
+		if s.dictionary != nil {
+			s.sendDictionary()
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// SetDictionary sets the source of the dictionary and sends the dictionary
+// SetDictionary is not thread safe with Log()
+func (s *DatagramSink) SetDictionary(dictionary DictionaryWriter) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dictionary = dictionary
+	return s.sendDictionary()
+}
+
+func (s *DatagramSink) FrameStart(io.Writer) {
+	s.mutex.Lock()
+	s.frame = append(s.frame[:0], 0, 0, 0, 0) // the sequence number
+}
+
+func (s *DatagramSink) TryFrameStart(ioWriter io.Writer, timeout time.Duration) bool {
+	if !tryLock(&s.mutex, timeout) {
+		return false
+	}
+	s.frame = append(s.frame[:0], 0, 0, 0, 0)
+	return true
+}
+
+// FrameEnd sends the frame. Without ADD_DICTIONARY the receiver needs the
+// dictionary before a new format string
+func (s *DatagramSink) FrameEnd(io.Writer) {
+	defer s.mutex.Unlock()
+	if versioned, ok := s.dictionary.(VersionedDictionary); ok && !ADD_DICTIONARY && versioned.DictionaryVersion() != s.dictionaryVersion {
+		s.sendDictionary()
+	}
+	// Log() failed before the first byte of the frame
+	if len(s.frame) > DATAGRAM_HEADER_SIZE {
+		s.send(s.frame)
+	}
+}
+
+// Write is called between FrameStart() and FrameEnd()
+func (s *DatagramSink) Write(data []byte) (int, error) {
+	s.frame = append(s.frame, data...)
+	return len(data), nil
+}
+
+func (s *DatagramSink) GetStatistics() DatagramSinkStatistics {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.statistics
+}
+
+// Close stops the goroutine and closes the connection
+func (s *DatagramSink) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.stopped.Wait()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// Pack the dictionary records into datagrams
+func (s *DatagramSink) sendDictionary() error {
+	if versioned, ok := s.dictionary.(VersionedDictionary); ok {
+		s.dictionaryVersion = versioned.DictionaryVersion()
+	}
+	var buf bytes.Buffer
+	if err := s.dictionary.WriteDictionary(&buf); err != nil {
+		s.statistics.Errors++
+		return err
+	}
+	records, err := splitRecords(buf.Bytes())
+	if err != nil {
+		s.statistics.Errors++
+		return err
+	}
+	datagram := make([]byte, DATAGRAM_HEADER_SIZE, s.config.MaxDatagramSize)
+	for _, record := range records {
+		if len(datagram)+len(record) > s.config.MaxDatagramSize && len(datagram) > DATAGRAM_HEADER_SIZE {
+			s.send(datagram)
+			datagram = datagram[:DATAGRAM_HEADER_SIZE]
+		}
+		datagram = append(datagram, record...)
+	}
+	if len(datagram) > DATAGRAM_HEADER_SIZE {
+		s.send(datagram)
+	}
+	return nil
+}
+
+// Send the datagram, the first DATAGRAM_HEADER_SIZE bytes are reserved for
+// the sequence number. Lost datagrams consume sequence numbers too
+func (s *DatagramSink) send(datagram []byte) {
+	binary.LittleEndian.PutUint32(datagram, s.sequence)
+	s.sequence++
+	if len(datagram) > s.config.MaxDatagramSize {
+		s.statistics.Dropped++
+		return
+	}
+	if s.conn == nil {
+		if time.Since(s.lastDial) < s.config.DictionaryInterval {
+			s.statistics.Dropped++
+			return
+		}
+		s.lastDial = time.Now()
+		conn, err := net.Dial(s.config.Network, s.config.Address)
+		if err != nil {
+			s.statistics.Errors++
+			s.statistics.Dropped++
+			return
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+	if _, err := s.conn.Write(datagram); err != nil {
+		s.statistics.Dropped++
+		// The unixgram receiver could restart, I dial again
+		if s.config.Network == "unixgram" {
+			s.conn.Close()
+			s.conn = nil
+		}
+		return
+	}
+	s.statistics.Datagrams++
+}
+
+// DatagramReceiver decodes the datagrams sent by DatagramSink
+// The receiver can start in the middle of the stream: the receiver skips
+// the log entries until the dictionary arrives
+//
+//	conn, _ := net.ListenPacket("udp", ":7070")
+//	receiver := NewDatagramReceiver(conn, nil, nil)
+//	for receiver.Next() {
+//		fmt.Println(Format(receiver.Entry()))
+//	}
+type DatagramReceiver struct {
+	conn       net.PacketConn
+	dictionary *Dictionary
+	options    DecoderOptions
+	datagram   []byte
+	reader     bytes.Reader
+	bufReader  *bufio.Reader
+	decoder    *Decoder
+	err        error
+
+	started    bool
+	expected   uint32 // the next sequence number
+	statistics DatagramReceiverStatistics
+
+	// The intern table of the datagrams in order, see INTERN_TABLE_SIZE
+	internTable map[uint64]string
+}
+
+type DatagramReceiverStatistics struct {
+	Datagrams uint64
+	Lost      uint64 // gaps in the sequence numbers
+	Reordered uint64 // datagrams arrived after a later datagram
+	Skipped   uint64 // datagrams the receiver failed to decode, for example, before the dictionary
+}
+
+// If options is nil the receiver uses DefaultDecoderOptions(). The stream
+// header in the dictionary overrides the options
+func NewDatagramReceiver(conn net.PacketConn, dictionary *Dictionary, options *DecoderOptions) *DatagramReceiver {
+	if dictionary == nil {
+		dictionary = NewDictionary()
+	}
+	if options == nil {
+		defaultOptions := DefaultDecoderOptions()
+		options = &defaultOptions
+	}
+	r := &DatagramReceiver{
+		conn:        conn,
+		dictionary:  dictionary,
+		options:     *options,
+		datagram:    make([]byte, 65536),
+		internTable: make(map[uint64]string),
+	}
+	r.bufReader = bufio.NewReader(&r.reader)
+	return r
+}
+
+// Next decodes the next log entry, see Entry()
+// Next returns false if the connection fails, see Err()
+func (r *DatagramReceiver) Next() bool {
+	for {
+		if r.decoder != nil {
+			if r.decoder.Next() {
+				return true
+			}
+			if r.decoder.Err() != nil {
+				r.statistics.Skipped++
+			}
+			r.options = r.decoder.Options()
+			r.decoder = nil
+		}
+		n, _, err := r.conn.ReadFrom(r.datagram)
+		if err != nil {
+			r.err = err
+			return false
+		}
+		if n < DATAGRAM_HEADER_SIZE {
+			r.statistics.Skipped++
+			continue
+		}
+		inOrder := r.updateStatistics(binary.LittleEndian.Uint32(r.datagram))
+		r.reader.Reset(r.datagram[DATAGRAM_HEADER_SIZE:n])
+		r.bufReader.Reset(&r.reader)
+		r.decoder = newDecoder(r.bufReader, 0, r.dictionary, r.options)
+		// A late datagram can not use or change the intern table
+		if inOrder {
+			r.decoder.internTable = r.internTable
+		}
+	}
+}
+
+// Returns false if the datagram arrived after a later datagram
+// A lost datagram could contain the define records, I drop the intern
+// table. The sink starts a new table with the next dictionary
+func (r *DatagramReceiver) updateStatistics(sequence uint32) bool {
+	r.statistics.Datagrams++
+	if !r.started {
+		r.started = true
+		r.expected = sequence + 1
+		return true
+	}
+	gap := int32(sequence - r.expected)
+	if gap < 0 {
+		r.statistics.Reordered++
+		if r.statistics.Lost > 0 {
+			r.statistics.Lost--
+		}
+		return false
+	}
+	if gap > 0 {
+		r.statistics.Lost += uint64(gap)
+		for slot := range r.internTable {
+			delete(r.internTable, slot)
+		}
+	}
+	r.expected = sequence + 1
+	return true
+}
+
+// Entry returns the log entry decoded by Next()
+func (r *DatagramReceiver) Entry() *LogEntry {
+	return r.decoder.Entry()
+}
+
+// Err returns the error which stopped Next()
+func (r *DatagramReceiver) Err() error {
+	return r.err
+}
+
+func (r *DatagramReceiver) GetStatistics() DatagramReceiverStatistics {
+	return r.statistics
+}
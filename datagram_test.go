@@ -0,0 +1,166 @@
+package binlog
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newDatagramLogger(t *testing.T, config DatagramSinkConfig) (*Binlog, *DatagramSink) {
+	sink := NewDatagramSink(config)
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: sink, WriterControl: sink, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	sink.SetDictionary(binlog)
+	return binlog, sink
+}
+
+func TestDatagramSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	binlog, sink := newDatagramLogger(t, DatagramSinkConfig{Network: "udp", Address: conn.LocalAddr().String(), MaxDatagramSize: 256})
+	defer sink.Close()
+
+	receiver := NewDatagramReceiver(conn, nil, nil)
+	for i := 0; i < 10; i++ {
+		binlog.Log("Hello %d", i)
+		// The frame is larger than MaxDatagramSize, the receiver counts the loss
+		binlog.Log("Hello %s", strings.Repeat("a", 256))
+	}
+	for i := 0; i < 10; i++ {
+		if !receiver.Next() {
+			t.Fatalf("Failed to receive %v", receiver.Err())
+		}
+		if expected, actual := fmt.Sprintf("Hello %d", i), Format(receiver.Entry()); actual != expected {
+			t.Fatalf("Print failed expected '%s', actual '%s'", expected, actual)
+		}
+	}
+	if statistics := sink.GetStatistics(); statistics.Dropped != 10 {
+		t.Fatalf("Unexpected sink statistics %v", statistics)
+	}
+	if statistics := receiver.GetStatistics(); statistics.Lost != 9 || statistics.Reordered != 0 {
+		t.Fatalf("Unexpected receiver statistics %v", statistics)
+	}
+}
+
+// The receiver misses the dictionary and decodes the log entries after the
+// sink sends the dictionary again
+func TestDatagramSinkLateReceiver(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "binlog.sock")
+	conn, err := net.ListenPacket("unixgram", address)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	binlog, sink := newDatagramLogger(t, DatagramSinkConfig{Network: "unixgram", Address: address, DictionaryInterval: 50 * time.Millisecond})
+	defer sink.Close()
+
+	binlog.Log("Hello %d", 0)
+	datagram := make([]byte, 65536)
+	for i := uint64(0); i < sink.GetStatistics().Datagrams; i++ {
+		if _, _, err := conn.ReadFrom(datagram); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	receiver := NewDatagramReceiver(conn, nil, nil)
+	binlog.Log("Hello %d", 1)
+	time.Sleep(60 * time.Millisecond)
+	binlog.Log("Hello %d", 2)
+	if !receiver.Next() {
+		t.Fatalf("Failed to receive %v", receiver.Err())
+	}
+	if log := Format(receiver.Entry()); log != "Hello 2" {
+		t.Fatalf("Print failed expected 'Hello 2', actual '%s'", log)
+	}
+	if statistics := receiver.GetStatistics(); statistics.Skipped != 1 || statistics.Lost != 0 {
+		t.Fatalf("Unexpected receiver statistics %v", statistics)
+	}
+}
+
+// The dictionary records keep the frame headers in the datagrams
+func TestDatagramSinkFramed(t *testing.T) {
+	ADD_FRAME_HEADER, ADD_FRAME_CRC = true, true
+	defer func() { ADD_FRAME_HEADER, ADD_FRAME_CRC = false, false }()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	binlog, sink := newDatagramLogger(t, DatagramSinkConfig{Network: "udp", Address: conn.LocalAddr().String()})
+	defer sink.Close()
+
+	// Without the options the receiver relies on the stream header
+	receiver := NewDatagramReceiver(conn, nil, &DecoderOptions{})
+	binlog.Log("Hello %s %d", "world", 1)
+	if !receiver.Next() {
+		t.Fatalf("Failed to receive %v", receiver.Err())
+	}
+	if log := Format(receiver.Entry()); log != "Hello world 1" {
+		t.Fatalf("Print failed expected 'Hello world 1', actual '%s'", log)
+	}
+}
+
+// The goroutine sends the dictionary while the logger is idle
+func TestDatagramSinkDictionaryInterval(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, sink := newDatagramLogger(t, DatagramSinkConfig{Network: "udp", Address: conn.LocalAddr().String(), DictionaryInterval: 10 * time.Millisecond})
+	sent := sink.GetStatistics().Datagrams
+	datagram := make([]byte, 65536)
+	for i := uint64(0); i <= sent; i++ {
+		if _, _, err := conn.ReadFrom(datagram); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	sink.Close()
+	statistics := sink.GetStatistics()
+	sink.Close()
+	if sink.GetStatistics() != statistics || statistics.Datagrams <= sent {
+		t.Fatalf("Unexpected statistics %v", statistics)
+	}
+}
+
+// The datagrams in order share the intern table
+func TestDatagramSinkInternTable(t *testing.T) {
+	INTERN_TABLE_SIZE = 4
+	defer func() { INTERN_TABLE_SIZE = 0 }()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	binlog, sink := newDatagramLogger(t, DatagramSinkConfig{Network: "udp", Address: conn.LocalAddr().String(), DictionaryInterval: time.Hour})
+	defer sink.Close()
+
+	receiver := NewDatagramReceiver(conn, nil, nil)
+	path := fmt.Sprintf("/%s", "index.html")
+	for i := 0; i < 3; i++ {
+		binlog.Log("Path %s", path)
+	}
+	for i := 0; i < 3; i++ {
+		if !receiver.Next() {
+			t.Fatalf("Failed to receive %v", receiver.Err())
+		}
+		if log := Format(receiver.Entry()); log != "Path /index.html" {
+			t.Fatalf("Print failed expected 'Path /index.html', actual '%s'", log)
+		}
+	}
+	// The new format string sends the dictionary, the second log entry
+	// starts a new table
+	if statistics := binlog.GetStatistics(); statistics.InternHit != 1 || statistics.InternMiss != 2 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+}
@@ -0,0 +1,631 @@
+package binlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"reflect"
+	"unsafe"
+)
+
+type LogEntry struct {
+	Filename   string
+	LineNumber int
+	FmtString  string
+	Args       []interface{}
+	Index      uint64
+	Timestamp  int64
+	Skipped    int  // bytes skipped looking for the sync marker of this frame
+	Marker     bool // the last log entry of the process, see WriteMarker()
+}
+
+// Format returns the log entry exactly as fmt.Sprintf() would print it
+func Format(logEntry *LogEntry) string {
+	return fmt.Sprintf(logEntry.FmtString, logEntry.Args...)
+}
+
+// DecoderOptions describe the layout of the frames in the binary stream
+// The options shall match the flags the binary stream was encoded with
+// If the binary stream starts with the stream header the decoder uses the
+// flags from the stream header, see WriteDictionary()
+type DecoderOptions struct {
+	SendLogIndex    bool
+	SendStringIndex bool
+	AddSourceLine   bool
+	AddTimestamp    bool
+	AddFrameHeader  bool
+	AddFrameCRC     bool
+}
+
+// DefaultDecoderOptions returns options matching the global flags, for
+// example, ADD_SOURCE_LINE
+func DefaultDecoderOptions() DecoderOptions {
+	return DecoderOptions{
+		SendLogIndex:    SEND_LOG_INDEX,
+		SendStringIndex: SEND_STRING_INDEX,
+		AddSourceLine:   ADD_SOURCE_LINE,
+		AddTimestamp:    ADD_TIMESTAMP,
+		AddFrameHeader:  ADD_FRAME_HEADER,
+		AddFrameCRC:     ADD_FRAME_CRC,
+	}
+}
+
+// Decoder reads log entries from a binary stream
+// Decoder reads complete fields even if the reader returns less data than
+// requested (pipes, sockets, bufio boundaries), tracks the offset in the
+// stream and does not allocate memory for the integer fields
+//
+// Typical usage is
+//
+//	decoder := NewDecoder(reader, binlog.GetDictionary(), nil)
+//	for decoder.Next() {
+//		fmt.Println(Format(decoder.Entry()))
+//	}
+//	err := decoder.Err()
+type Decoder struct {
+	reader     io.Reader // the binary stream
+	fields     io.Reader // the binary stream or the current frame if AddFrameHeader is set
+	offset     int64     // offset of the next byte in the binary stream
+	hasOffset  bool      // false if the offset of the binary stream is not known
+	dictionary *Dictionary
+	options    DecoderOptions
+	properties map[string]string // from the stream header
+	version    uint8             // from the stream header, 0 (the current version) if there is no header
+	started    bool              // true after the first frame
+
+	// The intern table of the logger, see INTERN_TABLE_SIZE
+	internTable   map[uint64]string
+	noInternTable bool // the table is gone after the call, see DecodeNext()
+
+	frameOffset int64  // offset of the current frame
+	frame       []byte // the size, the frame and the CRC if AddFrameHeader is set
+	replay      []byte // the bytes of the skipped frame after the sync marker, see resync()
+	frameReader bytes.Reader
+	crc         uint32 // checksum of the current frame if AddFrameCRC is set
+
+	// The current log entry for Next()/Entry()
+	// LogEntry.Args point to the integers and strings
+	entry    LogEntry
+	integers []uint64
+	strings  []string
+	err      error
+
+	scratch [8]byte
+}
+
+// NewDecoder returns a decoder reading from a bufio.Reader
+// If options is nil the decoder uses DefaultDecoderOptions()
+// If dictionary is nil the decoder relies on the dictionary records in
+// the binary stream. The decoder adds the dictionary records to the dictionary
+// Offsets are counted from the position of the reader when NewDecoder is called
+func NewDecoder(reader io.Reader, dictionary *Dictionary, options *DecoderOptions) *Decoder {
+	bufReader, ok := reader.(*bufio.Reader)
+	if !ok {
+		bufReader = bufio.NewReader(reader)
+	}
+	if options == nil {
+		defaultOptions := DefaultDecoderOptions()
+		options = &defaultOptions
+	}
+	if dictionary == nil {
+		dictionary = NewDictionary()
+	}
+	return newDecoder(bufReader, 0, dictionary, *options)
+}
+
+// The decoder reads exactly the frame and not a byte more if the reader
+// is not buffered
+func newDecoder(reader io.Reader, offset int64, dictionary *Dictionary, options DecoderOptions) *Decoder {
+	return &Decoder{
+		reader:     reader,
+		fields:     reader,
+		offset:     offset,
+		hasOffset:  offset >= 0,
+		dictionary: dictionary,
+		options:    options,
+	}
+}
+
+// Offset returns the offset of the next frame in the binary stream
+func (d *Decoder) Offset() int64 {
+	return d.offset
+}
+
+// Options returns the layout of the frames, including the flags from the
+// stream header
+func (d *Decoder) Options() DecoderOptions {
+	return d.options
+}
+
+// Properties returns the properties from the last stream header, for
+// example, the process ID
+func (d *Decoder) Properties() map[string]string {
+	return d.properties
+}
+
+// Next decodes the next log entry, see Entry()
+// Next returns false at the end of the stream or on error, see Err()
+// The application can call Next() again after an error, for example
+// ErrFrameSkipped, to continue with the next frame
+func (d *Decoder) Next() bool {
+	d.err = d.decodeNext(&d.entry)
+	if d.err == io.EOF {
+		d.err = nil
+		return false
+	}
+	return d.err == nil
+}
+
+// Entry returns the log entry decoded by Next()
+// The log entry, including the arguments, is valid until the next call to Next()
+func (d *Decoder) Entry() *LogEntry {
+	return &d.entry
+}
+
+// Err returns the error which stopped Next(), nil at the end of the stream
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// DecodeNext converts one record from the binary stream to a human readable format
+// You want to fmt.Sprintf(LogEntry.fmtString, LogEntry.args)
+// This API is slow - relies heavily on reflection, allocates strings and slices.
+// The idea is that I will not call this API often, and when I call the API I
+// will have a serious machine dedicated to the the task
+//
+// Decoding of the binary log is a three steps process:
+// 1. Read 4 bytes hash from the stream
+// 2. find the format string and arguments in the L1 or L2 cache
+// 3. Read arguments from the binary stream
+//
+// If ADD_FRAME_HEADER is set DecodeNext skips everything until the sync
+// marker, reads the whole frame and decodes the frame. See ErrFrameSkipped
+// If ADD_FRAME_CRC is set DecodeNext verifies the checksum of the frame.
+// See ErrCorruptedFrame
+//
+// DecodeNext returns io.EOF if the stream ends on the frame boundary and
+// ErrTruncated if the stream ends in the middle of a frame. See errors.go
+// for other errors
+//
+// DecodeNext does not buffer the reader and reads exactly one frame. If the
+// frame is skipped and the reader is an io.Seeker DecodeNext rewinds the
+// reader to the byte after the sync marker, see Decoder.resync(). Otherwise
+// DecodeNext skips the whole frame, use Decoder
+//
+// DecodeNext does not keep the intern table between the calls. If the
+// logger sets INTERN_TABLE_SIZE DecodeNext returns ErrNoInternTable for the
+// strings defined by the previous frames, use Decoder
+func DecodeNext(reader io.Reader, indexTable map[uint32]*Handler, filenames map[uint16]string) (*LogEntry, error) {
+	dictionary := &Dictionary{Handlers: indexTable, Filenames: filenames}
+	d := newDecoder(reader, getReaderOffset(reader), dictionary, DefaultDecoderOptions())
+	d.noInternTable = true
+	logEntry, err := d.DecodeNext()
+	if seeker, ok := reader.(io.Seeker); ok && len(d.replay) != 0 {
+		seeker.Seek(-int64(len(d.replay)), io.SeekCurrent)
+	}
+	return logEntry, err
+}
+
+// DecodeNext converts one record from the binary stream to a human readable format
+// Unlike Next() DecodeNext allocates a new log entry. See DecodeNext()
+func (d *Decoder) DecodeNext() (*LogEntry, error) {
+	logEntry := &LogEntry{}
+	d.integers, d.strings = nil, nil
+	if err := d.decodeNext(logEntry); err != nil {
+		return nil, err
+	}
+	return logEntry, nil
+}
+
+// The dictionary records are not log entries, I decode the records and
+// continue to the next frame
+func (d *Decoder) decodeNext(logEntry *LogEntry) error {
+	if !d.started {
+		d.started = true
+		d.detectStreamHeader()
+	}
+	skipped := 0
+	for {
+		err := d.decodeOne(logEntry)
+		if err != errDictionaryRecord {
+			if err == nil {
+				logEntry.Skipped += skipped
+			}
+			return err
+		}
+		skipped += logEntry.Skipped
+	}
+}
+
+// Returned by decodeFrame() after a dictionary record
+var errDictionaryRecord = errors.New("Dictionary record")
+
+func (d *Decoder) decodeOne(logEntry *LogEntry) error {
+	d.frameOffset = d.offset
+	d.fields = d.reader
+	d.crc = 0
+	if !d.options.AddFrameHeader {
+		err := d.decodeFrame(logEntry)
+		if err != nil && err != errDictionaryRecord {
+			return err
+		}
+		if d.options.AddFrameCRC {
+			if err := d.readFrameCRC(d.crc); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+	skipped, err := d.findFrameSync()
+	if err != nil {
+		return err
+	}
+	d.frameOffset = d.offset - 2
+	skipped += 2
+	// The frame buffer keeps the size, the frame and the CRC for resync()
+	if cap(d.frame) < 4 {
+		d.frame = make([]byte, 4, 256)
+	}
+	raw := d.frame[:4]
+	if err := d.readFull(raw); err != nil {
+		return d.truncated(err)
+	}
+	size := int(binary.LittleEndian.Uint32(raw))
+	if size > MAX_FRAME_SIZE {
+		return d.resync(raw, skipped, fmt.Errorf("Frame size %d is too large", size))
+	}
+	crcSize := 0
+	if d.options.AddFrameCRC {
+		crcSize = 4
+	}
+	if cap(d.frame) < 4+size+crcSize {
+		d.frame = make([]byte, 4+size+crcSize)
+		copy(d.frame, raw)
+	}
+	raw = d.frame[:4+size+crcSize]
+	if err := d.readFull(raw[4:]); err != nil {
+		// A corrupted size can point past the end of the stream
+		read := raw[:d.offset-d.frameOffset-2]
+		if bytes.Index(read, frameSyncBytes) < 0 {
+			return d.truncated(err)
+		}
+		return d.resync(read, skipped, d.truncated(err))
+	}
+	frame := raw[4 : 4+size]
+	if d.options.AddFrameCRC {
+		crc, expected := binary.LittleEndian.Uint32(raw[4+size:]), crc32.Checksum(frame, crc32cTable)
+		if crc != expected {
+			return d.resync(raw, skipped, &ErrCorruptedFrame{d.getFrameOffset(), crc, expected})
+		}
+	}
+	d.frameReader.Reset(frame)
+	d.fields = &d.frameReader
+	err = d.decodeFrame(logEntry)
+	d.fields = d.reader
+	if err == nil && d.frameReader.Len() != 0 {
+		err = fmt.Errorf("%d bytes left in the frame", d.frameReader.Len())
+	}
+	if err != nil && err != errDictionaryRecord {
+		// The CRC confirms the size, I skip the whole frame
+		if d.options.AddFrameCRC {
+			return &ErrFrameSkipped{skipped + len(raw), err}
+		}
+		return d.resync(raw, skipped, err)
+	}
+	logEntry.Skipped = skipped - 2
+	return err
+}
+
+var frameSyncBytes = []byte{byte(FRAME_SYNC & 0xFF), byte(FRAME_SYNC >> 8)}
+
+// The size of the frame can be corrupted. I skip only the sync marker and
+// return the rest of the frame to the stream, findFrameSync() looks for the
+// next sync marker from there
+func (d *Decoder) resync(raw []byte, skipped int, err error) error {
+	replay := make([]byte, 0, len(raw)+len(d.replay))
+	d.replay = append(append(replay, raw...), d.replay...)
+	d.offset -= int64(len(raw))
+	return &ErrFrameSkipped{skipped, err}
+}
+
+// Read exactly len(data) bytes
+// Returns io.EOF if there is no data and io.ErrUnexpectedEOF if there is
+// less data than required
+func (d *Decoder) readFull(data []byte) error {
+	n := 0
+	if d.fields == d.reader && len(d.replay) != 0 {
+		n = copy(data, d.replay)
+		d.replay = d.replay[n:]
+	}
+	var err error
+	if n < len(data) {
+		var count int
+		count, err = io.ReadFull(d.fields, data[n:])
+		if err == io.EOF && n != 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		n += count
+	}
+	if d.fields == d.reader {
+		d.offset += int64(n)
+		if d.options.AddFrameCRC {
+			d.crc = crc32.Update(d.crc, crc32cTable, data[:n])
+		}
+	}
+	return err
+}
+
+// Read 1, 2, 4 or 8 bytes of a little endian integer
+func (d *Decoder) readInteger(count int) (uint64, error) {
+	d.scratch = [8]byte{}
+	if err := d.readFull(d.scratch[:count]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(d.scratch[:]), nil
+}
+
+// Read 16 bits length of the string followed by the string itself
+// The string is the only field which requires memory allocation
+// The string header is varint of (length << 2 | kind), if the string
+// is truncated the number of dropped bytes follows. If the string is
+// interned the header contains the ID of the string or the slot in the
+// intern table. Version 1 of the stream
+// has 16 bits length, version 2 has varint of (length << 1 | truncated)
+func (d *Decoder) readString() (string, error) {
+	var count, dropped uint64
+	var err error
+	kind := stringPlain
+	switch d.version {
+	case 1:
+		count, err = d.readInteger(2)
+	case 2:
+		if count, err = d.readUvarint(); err == nil {
+			kind = int(count & 1)
+			count >>= 1
+		}
+	default:
+		if count, err = d.readUvarint(); err == nil {
+			kind = int(count & 3)
+			count >>= 2
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	switch kind {
+	case stringTruncated:
+		if dropped, err = d.readUvarint(); err != nil {
+			return "", err
+		}
+	case stringInterned:
+		if s, ok := d.dictionary.Strings[count]; ok {
+			return s, nil
+		}
+		return "", &ErrUnknownString{count}
+	case stringDynamic:
+		if s, ok := d.internTable[count]; ok {
+			return s, nil
+		}
+		if d.noInternTable {
+			return "", &ErrNoInternTable{count}
+		}
+		return "", &ErrUnknownString{count}
+	case stringPlain:
+	default:
+		return "", fmt.Errorf("Unknown kind %d of the string", kind)
+	}
+	truncated := kind == stringTruncated
+	if count > MAX_FRAME_SIZE {
+		return "", &ErrStringTooLong{count}
+	}
+	if count == 0 && !truncated {
+		return "", nil
+	}
+	data := make([]byte, count)
+	if err := d.readFull(data); err != nil {
+		return "", io.ErrUnexpectedEOF
+	}
+	if truncated {
+		data = append(data, fmt.Sprintf(TRUNCATED_FMT, dropped)...)
+	}
+	// Nobody else references the slice, I can skip the copy
+	return *(*string)(unsafe.Pointer(&data)), nil
+}
+
+// TRUNCATED_FMT is the marker the decoder adds to the truncated strings,
+// see MAX_STRING_LENGTH
+const TRUNCATED_FMT = "...[%d bytes truncated]"
+
+// Read 32 bits CRC of the frame and compare with the expected value
+func (d *Decoder) readFrameCRC(expected uint32) error {
+	crc, err := d.readInteger(4)
+	if err != nil {
+		return d.truncated(err)
+	}
+	if uint32(crc) != expected {
+		return &ErrCorruptedFrame{d.getFrameOffset(), uint32(crc), expected}
+	}
+	return nil
+}
+
+// Returns offset of the current frame, -1 if the offset is not known
+func (d *Decoder) getFrameOffset() int64 {
+	if !d.hasOffset {
+		return -1
+	}
+	return d.frameOffset
+}
+
+func (d *Decoder) truncated(err error) error {
+	return truncated(d.getFrameOffset(), err)
+}
+
+// Returns the current offset in the stream if the reader is an io.Seeker
+func getReaderOffset(reader io.Reader) int64 {
+	if seeker, ok := reader.(io.Seeker); ok {
+		if offset, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			return offset
+		}
+	}
+	return -1
+}
+
+// Read the stream byte by byte until the sync marker
+// Return number of bytes skipped before the marker
+func (d *Decoder) findFrameSync() (int, error) {
+	sync := d.scratch[:2]
+	skipped := 0
+	if err := d.readFull(sync); err != nil {
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		return 0, d.truncated(err)
+	}
+	for binary.LittleEndian.Uint16(sync) != FRAME_SYNC {
+		sync[0] = sync[1]
+		if err := d.readFull(sync[1:]); err != nil {
+			return skipped, d.truncated(err)
+		}
+		skipped++
+	}
+	return skipped, nil
+}
+
+// Read the frame from d.fields
+// The arguments are stored in d.integers and d.strings, LogEntry.Args point to
+// the stored values
+func (d *Decoder) decodeFrame(logEntry *LogEntry) error {
+	*logEntry = LogEntry{Args: logEntry.Args[:0]}
+	var h *Handler
+	// Read format string hash
+	if hashUint, err := d.readInteger(4); err == nil {
+		if uint32(hashUint) == DICTIONARY_HASH {
+			return d.decodeRecord(logEntry)
+		}
+		var ok bool
+		if h, ok = d.dictionary.Handlers[uint32(hashUint)]; !ok {
+			return &ErrUnknownHash{uint32(hashUint)}
+		}
+	} else if err == io.EOF {
+		return err
+	} else {
+		return d.truncated(err)
+	}
+
+	if d.options.SendStringIndex {
+		// Read format string index
+		if index, err := d.readInteger(4); err == nil {
+			if uint32(index) != h.IndexUint {
+				return &ErrIndexMismatch{uint32(index), h.IndexUint}
+			}
+		} else {
+			return d.truncated(err)
+		}
+	}
+	if d.options.AddSourceLine {
+		// Read filename hash and source line number from the binary stream
+		if filenameHash, err := d.readInteger(2); err == nil {
+			filename, ok := d.dictionary.Filenames[uint16(filenameHash)]
+			if !ok {
+				return &ErrUnknownFilename{uint16(filenameHash)}
+			}
+			logEntry.Filename = filename
+		} else {
+			return d.truncated(err)
+		}
+		if lineNumber, err := d.readInteger(2); err == nil {
+			logEntry.LineNumber = int(lineNumber)
+		} else {
+			return d.truncated(err)
+		}
+	}
+	if d.options.SendLogIndex {
+		// Read log index - running counter of logs
+		if logEntryIndex, err := d.readInteger(8); err == nil {
+			logEntry.Index = logEntryIndex
+		} else {
+			return d.truncated(err)
+		}
+	}
+	if d.options.AddTimestamp {
+		// Read 64 bits of timestamp from the stream
+		if timestamp, err := d.readInteger(8); err == nil {
+			logEntry.Timestamp = int64(timestamp)
+		} else {
+			return d.truncated(err)
+		}
+	}
+
+	// The pointers to the values shall remain valid while I read the frame
+	argsCount := len(h.Args.args)
+	if cap(d.integers) < argsCount {
+		d.integers = make([]uint64, argsCount)
+	}
+	if cap(d.strings) < argsCount {
+		d.strings = make([]string, argsCount)
+	}
+	integers, strings := d.integers[:argsCount], d.strings[:argsCount]
+	// Read arguments from the binary stream
+	for i, hArg := range h.Args.args {
+		var data unsafe.Pointer
+		if isIntegral(hArg.decodeArg.argType) {
+			count := hArg.writer.getSize() // size of the integer I pushed into the binary stream
+			value, err := d.readInteger(count)
+			if err != nil {
+				return d.truncated(err)
+			}
+			// Little endian: int8, int16, int32 are the lower bytes of the uint64
+			integers[i] = value
+			data = unsafe.Pointer(&integers[i])
+		} else if hArg.decodeArg.argKind == reflect.String {
+			value, err := d.readString()
+			if err != nil {
+				return d.truncated(err)
+			}
+			strings[i] = value
+			data = unsafe.Pointer(&strings[i])
+		} else {
+			return &ErrUnsupportedType{hArg.decodeArg.argType}
+		}
+		logEntry.Args = append(logEntry.Args, makeInterface(hArg.decodeArg.argTypeWord, data))
+	}
+	logEntry.FmtString = h.Args.fmtString
+	return nil
+}
+
+// Returns interface{} of the given type pointing to the data
+// This is what Go does when it converts a value to interface{}, without
+// allocating memory for the value
+func makeInterface(typeWord unsafe.Pointer, data unsafe.Pointer) interface{} {
+	var arg interface{}
+	argIface := (*iface)(unsafe.Pointer(&arg))
+	argIface.tab = typeWord
+	argIface.data = data
+	return arg
+}
+
+func isIntegral(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	case reflect.Int, reflect.Uint:
+		return true
+	default:
+		return false
+	}
+}
+
+func isUnsigned(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Uint, reflect.Uint32, reflect.Uint64, reflect.Uint8, reflect.Uint16:
+		return true
+	default:
+		return false
+	}
+}
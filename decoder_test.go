@@ -0,0 +1,210 @@
+package binlog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecoderOneByteReader(t *testing.T) {
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, TimestampDummy})
+
+	expected := []string{}
+	offsets := []int64{}
+	binlog.Log("Hello %d", 1)
+	expected, offsets = append(expected, "Hello 1"), append(offsets, int64(buf.Len()))
+	binlog.Log("Hello %s %d", "world", int8(2))
+	expected, offsets = append(expected, "Hello world 2"), append(offsets, int64(buf.Len()))
+	binlog.Log("Hello %s", "")
+	expected, offsets = append(expected, "Hello "), append(offsets, int64(buf.Len()))
+
+	decoder := NewDecoder(iotest.OneByteReader(&buf), binlog.GetDictionary(), nil)
+	for i := range expected {
+		logEntry, err := decoder.DecodeNext()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if actual := fmt.Sprintf(logEntry.FmtString, logEntry.Args...); actual != expected[i] {
+			t.Fatalf("Print failed expected '%s', actual '%s'", expected[i], actual)
+		}
+		if decoder.Offset() != offsets[i] {
+			t.Fatalf("Offset is %d instead of %d", decoder.Offset(), offsets[i])
+		}
+	}
+	if _, err := decoder.DecodeNext(); err != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+}
+
+func TestDecoderCorruptedFrameOffset(t *testing.T) {
+	ADD_FRAME_HEADER, ADD_FRAME_CRC = true, true
+	defer func() { ADD_FRAME_HEADER, ADD_FRAME_CRC = false, false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, TimestampDummy})
+
+	binlog.Log("Hello %d", 1)
+	frameSize := buf.Len()
+	binlog.Log("Hello %d", 2)
+	binlog.Log("Hello %d", 3)
+	// Flip a bit in the argument of the second frame
+	buf.Bytes()[2*frameSize-5] ^= 0x01
+
+	// bytes.Buffer is not an io.Seeker, the decoder counts the offset
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), nil)
+	if _, err := decoder.DecodeNext(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	var errCorruptedFrame *ErrCorruptedFrame
+	if _, err := decoder.DecodeNext(); !errors.As(err, &errCorruptedFrame) {
+		t.Fatalf("Expected ErrCorruptedFrame, got %v", err)
+	}
+	if errCorruptedFrame.Offset != int64(frameSize) {
+		t.Fatalf("Offset is %d instead of %d", errCorruptedFrame.Offset, frameSize)
+	}
+	logEntry, err := decoder.DecodeNext()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if actual := fmt.Sprintf(logEntry.FmtString, logEntry.Args...); actual != "Hello 3" {
+		t.Fatalf("Print failed expected '%s', actual '%s'", "Hello 3", actual)
+	}
+}
+
+func TestDecoderNext(t *testing.T) {
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, TimestampDummy})
+
+	expected := []string{}
+	binlog.Log("Signed %d %d %d %x %d", int8(-1), int16(-2), int32(-3), int64(-4), -5)
+	expected = append(expected, fmt.Sprintf("Signed %d %d %d %x %d", int8(-1), int16(-2), int32(-3), int64(-4), -5))
+	binlog.Log("Unsigned %d %d %d %x %d", uint8(0xFF), uint16(0xFFFF), uint32(0xFFFFFFFF), uint64(1<<63), uint(6))
+	expected = append(expected, fmt.Sprintf("Unsigned %d %d %d %x %d", uint8(0xFF), uint16(0xFFFF), uint32(0xFFFFFFFF), uint64(1<<63), uint(6)))
+	binlog.Log("Hello %s %d", "world", 7)
+	expected = append(expected, fmt.Sprintf("Hello %s %d", "world", 7))
+
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), nil)
+	count := 0
+	for decoder.Next() {
+		if actual := Format(decoder.Entry()); actual != expected[count] {
+			t.Fatalf("Print failed expected '%s', actual '%s'", expected[count], actual)
+		}
+		count++
+	}
+	if err := decoder.Err(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if count != len(expected) {
+		t.Fatalf("Decoded %d entries instead of %d", count, len(expected))
+	}
+}
+
+func TestDecoderNextSkippedFrame(t *testing.T) {
+	options := DefaultDecoderOptions()
+	options.AddFrameHeader = true
+	ADD_FRAME_HEADER = true
+	defer func() { ADD_FRAME_HEADER = false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, TimestampDummy})
+
+	binlog.Log("Hello %d", 1)
+	binlog.Log("Hello %d", 2)
+	// Corrupt the hash of the first frame
+	buf.Bytes()[FRAME_HEADER_SIZE] ^= 0xFF
+
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), &options)
+	if decoder.Next() {
+		t.Fatalf("Expected ErrFrameSkipped")
+	}
+	if !errors.Is(decoder.Err(), &ErrFrameSkipped{}) || !errors.Is(decoder.Err(), &ErrUnknownHash{}) {
+		t.Fatalf("Expected ErrFrameSkipped, got %v", decoder.Err())
+	}
+	if !decoder.Next() {
+		t.Fatalf("%v", decoder.Err())
+	}
+	if actual := Format(decoder.Entry()); actual != "Hello 2" {
+		t.Fatalf("Print failed expected '%s', actual '%s'", "Hello 2", actual)
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, TimestampDummy})
+	for i := 0; i < b.N; i++ {
+		binlog.Log("Hello %d %d %d", i, i+1, i+2)
+	}
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), nil)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decoder.DecodeNext(); err != nil {
+			b.Fatalf("%v", err)
+		}
+	}
+}
+
+func BenchmarkDecoderNext(b *testing.B) {
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, TimestampDummy})
+	for i := 0; i < b.N; i++ {
+		binlog.Log("Hello %d %d %d", i, i+1, i+2)
+	}
+	decoder := NewDecoder(&buf, binlog.GetDictionary(), nil)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !decoder.Next() {
+			b.Fatalf("%v", decoder.Err())
+		}
+	}
+}
+
+// A bit flip in the size of the frame skips only the frame
+func TestDecoderCorruptedFrameSize(t *testing.T) {
+	for _, crc := range []bool{false, true} {
+		ADD_FRAME_HEADER, ADD_FRAME_CRC = true, crc
+		var buf bytes.Buffer
+		constDataBase, constDataSize := GetSelfTextAddressSize()
+		binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, TimestampDummy})
+		offsets := []int{}
+		for i := 0; i < 10; i++ {
+			offsets = append(offsets, buf.Len())
+			binlog.Log("Hello %d", i)
+		}
+		ADD_FRAME_HEADER, ADD_FRAME_CRC = false, false
+		data := buf.Bytes()
+		// The size covers the next frames
+		data[offsets[2]+3] ^= 0x01
+		// The size points past the end of the stream
+		data[offsets[8]+4] ^= 0x01
+
+		options := DefaultDecoderOptions()
+		options.AddFrameHeader, options.AddFrameCRC = true, crc
+		decoder := NewDecoder(bytes.NewReader(data), binlog.GetDictionary(), &options)
+		logs, skipped := []string{}, 0
+		for {
+			if decoder.Next() {
+				logs = append(logs, Format(decoder.Entry()))
+				continue
+			}
+			if !errors.Is(decoder.Err(), &ErrFrameSkipped{}) {
+				break
+			}
+			skipped++
+		}
+		if decoder.Err() != nil {
+			t.Fatalf("CRC %v: %v", crc, decoder.Err())
+		}
+		expected := []string{"Hello 0", "Hello 1", "Hello 3", "Hello 4", "Hello 5", "Hello 6", "Hello 7", "Hello 9"}
+		if fmt.Sprint(logs) != fmt.Sprint(expected) || skipped != 2 {
+			t.Fatalf("CRC %v: skipped %d frames, decoded %v", crc, skipped, logs)
+		}
+	}
+}
@@ -0,0 +1,624 @@
+package binlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// The dictionary records carry the format strings and the filenames in the
+// binary stream. A decoder which reads the records does not need access to
+// the logger. A dictionary record is a frame with the hash DICTIONARY_HASH
+// followed by the record type and the record body:
+//
+//	stream header: magic, version, flags, properties
+//	filename:      filename hash, filename
+//	handler:       hash, index, filename hash, line, format string, arguments
+//	marker:        timestamp, reason, message, stack
+//	string:        ID, string - an interned string argument
+//	define string: slot, string - a string in the intern table
+//
+// The records have the frame header and the CRC if ADD_FRAME_HEADER and
+// ADD_FRAME_CRC are set. Other optional fields (index, timestamp) are not
+// present in the records
+// The strings in the records are varint length followed by the string
+// The records start with the stream header, the decoder uses the flags in
+// the stream header instead of the DecoderOptions
+
+// DICTIONARY_HASH is the reserved format string hash of the dictionary records
+const DICTIONARY_HASH uint32 = 0
+
+// STREAM_VERSION is the version of the binary stream format in the stream header
+// Version 2 - varint length of the string arguments
+// Version 3 - interned string arguments
+// Version 4 - the intern table of the runtime strings
+// Version 5 - the reset record of the intern table
+const STREAM_VERSION uint8 = 5
+
+const STREAM_MAGIC = "binlog"
+
+// Types of the dictionary records
+const (
+	recordStreamHeader uint8 = 1
+	recordFilename     uint8 = 2
+	recordHandler      uint8 = 3
+	recordMarker       uint8 = 4
+	recordString       uint8 = 5
+	recordDefineString uint8 = 6
+	recordResetStrings uint8 = 7
+)
+
+// Bits of the flags in the stream header
+const (
+	flagSendLogIndex uint32 = 1 << iota
+	flagSendStringIndex
+	flagAddSourceLine
+	flagAddTimestamp
+	flagAddFrameHeader
+	flagAddFrameCRC
+)
+
+// Dictionary contains everything the decoder needs to know about the
+// format strings. See Binlog.GetDictionary() and ReadDictionary()
+type Dictionary struct {
+	Handlers  map[uint32]*Handler // map[format string hash]*Handler
+	Filenames map[uint16]string   // map[filename hash]filename
+	Strings   map[uint64]string   // map[ID]interned string argument
+}
+
+// NewDictionary returns an empty dictionary, for example, for a decoder
+// which collects the dictionary records from the binary stream
+func NewDictionary() *Dictionary {
+	return &Dictionary{Handlers: make(map[uint32]*Handler), Filenames: make(map[uint16]string), Strings: make(map[uint64]string)}
+}
+
+// Returns the stream header flags matching the options
+func (o *DecoderOptions) flags() uint32 {
+	var flags uint32
+	bits := []struct {
+		option bool
+		flag   uint32
+	}{
+		{o.SendLogIndex, flagSendLogIndex},
+		{o.SendStringIndex, flagSendStringIndex},
+		{o.AddSourceLine, flagAddSourceLine},
+		{o.AddTimestamp, flagAddTimestamp},
+		{o.AddFrameHeader, flagAddFrameHeader},
+		{o.AddFrameCRC, flagAddFrameCRC},
+	}
+	for _, bit := range bits {
+		if bit.option {
+			flags |= bit.flag
+		}
+	}
+	return flags
+}
+
+func (o *DecoderOptions) setFlags(flags uint32) {
+	o.SendLogIndex = (flags & flagSendLogIndex) != 0
+	o.SendStringIndex = (flags & flagSendStringIndex) != 0
+	o.AddSourceLine = (flags & flagAddSourceLine) != 0
+	o.AddTimestamp = (flags & flagAddTimestamp) != 0
+	o.AddFrameHeader = (flags & flagAddFrameHeader) != 0
+	o.AddFrameCRC = (flags & flagAddFrameCRC) != 0
+}
+
+// WriteDictionary writes the stream header followed by all format strings
+// and filenames the logger encountered so far
+// The application can write the dictionary to a separate file or in the
+// beginning of the binary log. For example,
+//
+//	binlog.WriteDictionary(file)
+//	... // binlog.Log() calls
+//	binlog.WriteDictionary(dictionaryFile)
+//
+// The decoder can start after the dictionary, the next log entry starts
+// a new intern table, see ResetInternTable()
+// WriteDictionary is not thread safe with Log()
+func (b *Binlog) WriteDictionary(ioWriter io.Writer) error {
+	b.ResetInternTable()
+	options := DefaultDecoderOptions()
+	if err := writeRecord(ioWriter, encodeStreamHeader(&options, b.properties)); err != nil {
+		return err
+	}
+	// Sort the records by hash, the same logger produces the same dictionary
+	filenameHashes := make([]int, 0, len(b.Filenames))
+	for hash := range b.Filenames {
+		filenameHashes = append(filenameHashes, int(hash))
+	}
+	sort.Ints(filenameHashes)
+	for _, hash := range filenameHashes {
+		record := encodeFilename(uint16(hash), b.Filenames[uint16(hash)])
+		if err := writeRecord(ioWriter, record); err != nil {
+			return err
+		}
+	}
+	for _, s := range b.constStringsByID {
+		if err := writeRecord(ioWriter, encodeString(s.id, s.value)); err != nil {
+			return err
+		}
+	}
+	hashes := make([]int, 0, len(b.handlersLookupByHash))
+	for hash := range b.handlersLookupByHash {
+		hashes = append(hashes, int(hash))
+	}
+	sort.Ints(hashes)
+	for _, hash := range hashes {
+		record := encodeHandler(b.handlersLookupByHash[uint32(hash)])
+		if err := writeRecord(ioWriter, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadDictionary reads the dictionary records written by WriteDictionary()
+// Returns the dictionary and the options from the stream header
+func ReadDictionary(reader io.Reader) (*Dictionary, *DecoderOptions, error) {
+	decoder := NewDecoder(reader, NewDictionary(), nil)
+	if decoder.Next() {
+		return nil, nil, fmt.Errorf("Unexpected log entry at offset %d", decoder.frameOffset)
+	}
+	if err := decoder.Err(); err != nil {
+		return nil, nil, err
+	}
+	options := decoder.Options()
+	return decoder.dictionary, &options, nil
+}
+
+// ScanDictionary reads the whole binary stream and collects the dictionary
+// records, for example, the dictionary the panic hook writes in the end of
+// the stream. Skipping of the log entries with unknown format strings
+// requires the frame headers. See also InstallSignalHandler()
+// Returns the dictionary and the options from the last stream header
+func ScanDictionary(reader io.Reader, options *DecoderOptions) (*Dictionary, *DecoderOptions, error) {
+	decoder := NewDecoder(reader, NewDictionary(), options)
+	for {
+		for decoder.Next() {
+		}
+		err := decoder.Err()
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, &ErrFrameSkipped{}) {
+			return nil, nil, err
+		}
+	}
+	scannedOptions := decoder.Options()
+	return decoder.dictionary, &scannedOptions, nil
+}
+
+// Returns the records, including the frame headers and CRC, in the output
+// of WriteDictionary()
+func splitRecords(data []byte) ([][]byte, error) {
+	decoder := NewDecoder(bytes.NewReader(data), NewDictionary(), nil)
+	decoder.started = true
+	decoder.detectStreamHeader()
+	records := [][]byte{}
+	var logEntry LogEntry
+	for {
+		start := decoder.Offset()
+		err := decoder.decodeOne(&logEntry)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != errDictionaryRecord {
+			return nil, fmt.Errorf("Unexpected log entry at offset %d: %v", start, err)
+		}
+		records = append(records, data[start:decoder.Offset()])
+	}
+}
+
+// Write the record with the frame header and CRC if required
+func writeRecord(ioWriter io.Writer, record []byte) error {
+	if ADD_FRAME_HEADER {
+		var frameHeader [FRAME_HEADER_SIZE]byte
+		binary.LittleEndian.PutUint16(frameHeader[0:], FRAME_SYNC)
+		binary.LittleEndian.PutUint32(frameHeader[2:], uint32(len(record)))
+		if _, err := ioWriter.Write(frameHeader[:]); err != nil {
+			return err
+		}
+	}
+	if _, err := ioWriter.Write(record); err != nil {
+		return err
+	}
+	if ADD_FRAME_CRC {
+		var frameCRC [4]byte
+		binary.LittleEndian.PutUint32(frameCRC[:], crc32.Checksum(record, crc32cTable))
+		if _, err := ioWriter.Write(frameCRC[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordEncoder collects the fields of a dictionary record
+type recordEncoder struct {
+	bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func newRecordEncoder(recordType uint8) *recordEncoder {
+	e := &recordEncoder{}
+	e.putUint(uint64(DICTIONARY_HASH), 4)
+	e.putUint(uint64(recordType), 1)
+	return e
+}
+
+// Little endian integer of 1, 2, 4 or 8 bytes
+func (e *recordEncoder) putUint(value uint64, count int) {
+	binary.LittleEndian.PutUint64(e.scratch[:], value)
+	e.Write(e.scratch[:count])
+}
+
+func (e *recordEncoder) putUvarint(value uint64) {
+	n := binary.PutUvarint(e.scratch[:], value)
+	e.Write(e.scratch[:n])
+}
+
+func (e *recordEncoder) putString(s string) {
+	e.putUvarint(uint64(len(s)))
+	e.WriteString(s)
+}
+
+func encodeStreamHeader(options *DecoderOptions, properties map[string]string) []byte {
+	e := newRecordEncoder(recordStreamHeader)
+	e.putString(STREAM_MAGIC)
+	e.putUint(uint64(STREAM_VERSION), 1)
+	e.putUint(uint64(options.flags()), 4)
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	e.putUvarint(uint64(len(keys)))
+	for _, key := range keys {
+		e.putString(key)
+		e.putString(properties[key])
+	}
+	return e.Bytes()
+}
+
+func encodeFilename(hash uint16, filename string) []byte {
+	e := newRecordEncoder(recordFilename)
+	e.putUint(uint64(hash), 2)
+	e.putString(filename)
+	return e.Bytes()
+}
+
+func encodeString(id uint64, s string) []byte {
+	e := newRecordEncoder(recordString)
+	e.putUvarint(id)
+	e.putString(s)
+	return e.Bytes()
+}
+
+// The define records are not in the dictionary, see INTERN_TABLE_SIZE
+func encodeDefineString(slot uint64, s string) []byte {
+	e := newRecordEncoder(recordDefineString)
+	e.putUvarint(slot)
+	e.putString(s)
+	return e.Bytes()
+}
+
+// The decoder drops the intern table, see ResetInternTable()
+func encodeResetStrings() []byte {
+	return newRecordEncoder(recordResetStrings).Bytes()
+}
+
+// For every argument I keep the format verb, the kind of the argument and
+// the number of bytes in the binary stream
+func encodeHandler(h *Handler) []byte {
+	e := newRecordEncoder(recordHandler)
+	e.putUint(uint64(h.HashUint), 4)
+	e.putUint(uint64(h.IndexUint), 4)
+	e.putUint(uint64(h.FilenameHashUint), 2)
+	e.putUint(uint64(h.LineNumberUint), 2)
+	e.putString(h.Args.fmtString)
+	e.putUvarint(uint64(len(h.Args.args)))
+	for _, hArg := range h.Args.args {
+		e.putUvarint(uint64(hArg.fmtVerb))
+		e.putUint(uint64(hArg.decodeArg.argKind), 1)
+		e.putUint(uint64(hArg.writer.getSize()), 1)
+	}
+	return e.Bytes()
+}
+
+// Types of the arguments the decoder can restore from the dictionary records
+// Named types, for example "type MyInt int", are decoded as the underlying type
+var kindTypes = map[reflect.Kind]reflect.Type{
+	reflect.Int:    reflect.TypeOf(int(0)),
+	reflect.Int8:   reflect.TypeOf(int8(0)),
+	reflect.Int16:  reflect.TypeOf(int16(0)),
+	reflect.Int32:  reflect.TypeOf(int32(0)),
+	reflect.Int64:  reflect.TypeOf(int64(0)),
+	reflect.Uint:   reflect.TypeOf(uint(0)),
+	reflect.Uint8:  reflect.TypeOf(uint8(0)),
+	reflect.Uint16: reflect.TypeOf(uint16(0)),
+	reflect.Uint32: reflect.TypeOf(uint32(0)),
+	reflect.Uint64: reflect.TypeOf(uint64(0)),
+	reflect.String: reflect.TypeOf(""),
+}
+
+// Read the record type and the record body following DICTIONARY_HASH
+// The stream header updates the options, the marker is a log entry, other
+// records update the dictionary. Returns errDictionaryRecord if the record
+// is not a log entry
+func (d *Decoder) decodeRecord(logEntry *LogEntry) error {
+	recordType, err := d.readInteger(1)
+	if err != nil {
+		return d.truncated(err)
+	}
+	switch uint8(recordType) {
+	case recordStreamHeader:
+		err = d.decodeStreamHeader()
+	case recordFilename:
+		err = d.decodeFilename()
+	case recordHandler:
+		err = d.decodeHandler()
+	case recordMarker:
+		return d.decodeMarker(logEntry)
+	case recordString:
+		err = d.decodeString()
+	case recordDefineString:
+		err = d.decodeDefineString()
+	case recordResetStrings:
+		// The map can be shared, see DatagramReceiver
+		for slot := range d.internTable {
+			delete(d.internTable, slot)
+		}
+	default:
+		return &ErrBadRecord{uint8(recordType), "unknown record type"}
+	}
+	if err != nil {
+		return err
+	}
+	return errDictionaryRecord
+}
+
+func encodeMarker(timestamp int64, reason string, message string, stack string) []byte {
+	e := newRecordEncoder(recordMarker)
+	e.putUint(uint64(timestamp), 8)
+	e.putString(reason)
+	e.putString(message)
+	e.putString(stack)
+	return e.Bytes()
+}
+
+// The marker is a log entry "reason: message\nstack"
+func (d *Decoder) decodeMarker(logEntry *LogEntry) error {
+	timestamp, err := d.readInteger(8)
+	if err != nil {
+		return d.truncated(err)
+	}
+	args := make([]interface{}, 3)
+	for i := range args {
+		s, err := d.readRecordString()
+		if err != nil {
+			return err
+		}
+		args[i] = s
+	}
+	logEntry.FmtString = MARKER_FMT_STRING
+	logEntry.Args = args
+	logEntry.Timestamp = int64(timestamp)
+	logEntry.Marker = true
+	return nil
+}
+
+func (d *Decoder) decodeStreamHeader() error {
+	magic, err := d.readRecordString()
+	if err != nil {
+		return err
+	}
+	if magic != STREAM_MAGIC {
+		return &ErrBadRecord{recordStreamHeader, fmt.Sprintf("magic is '%s'", magic)}
+	}
+	version, err := d.readInteger(1)
+	if err != nil {
+		return d.truncated(err)
+	}
+	if uint8(version) > STREAM_VERSION {
+		return &ErrBadRecord{recordStreamHeader, fmt.Sprintf("unsupported version %d", version)}
+	}
+	d.version = uint8(version)
+	flags, err := d.readInteger(4)
+	if err != nil {
+		return d.truncated(err)
+	}
+	count, err := d.readUvarint()
+	if err != nil {
+		return err
+	}
+	properties := make(map[string]string)
+	for i := uint64(0); i < count; i++ {
+		key, err := d.readRecordString()
+		if err != nil {
+			return err
+		}
+		value, err := d.readRecordString()
+		if err != nil {
+			return err
+		}
+		properties[key] = value
+	}
+	d.options.setFlags(uint32(flags))
+	d.properties = properties
+	return nil
+}
+
+func (d *Decoder) decodeFilename() error {
+	hash, err := d.readInteger(2)
+	if err != nil {
+		return d.truncated(err)
+	}
+	filename, err := d.readRecordString()
+	if err != nil {
+		return err
+	}
+	if d.dictionary.Filenames == nil {
+		d.dictionary.Filenames = make(map[uint16]string)
+	}
+	d.dictionary.Filenames[uint16(hash)] = filename
+	return nil
+}
+
+func (d *Decoder) decodeString() error {
+	id, err := d.readUvarint()
+	if err != nil {
+		return err
+	}
+	s, err := d.readRecordString()
+	if err != nil {
+		return err
+	}
+	if d.dictionary.Strings == nil {
+		d.dictionary.Strings = make(map[uint64]string)
+	}
+	d.dictionary.Strings[id] = s
+	return nil
+}
+
+func (d *Decoder) decodeDefineString() error {
+	slot, err := d.readUvarint()
+	if err != nil {
+		return err
+	}
+	s, err := d.readRecordString()
+	if err != nil {
+		return err
+	}
+	if d.internTable == nil {
+		d.internTable = make(map[uint64]string)
+	}
+	d.internTable[slot] = s
+	return nil
+}
+
+func (d *Decoder) decodeHandler() error {
+	var fields [4]uint64
+	for i, count := range []int{4, 4, 2, 2} {
+		value, err := d.readInteger(count)
+		if err != nil {
+			return d.truncated(err)
+		}
+		fields[i] = value
+	}
+	fmtString, err := d.readRecordString()
+	if err != nil {
+		return err
+	}
+	argsCount, err := d.readUvarint()
+	if err != nil {
+		return err
+	}
+	if argsCount > uint64(len(fmtString)) {
+		return &ErrBadRecord{recordHandler, fmt.Sprintf("%d arguments in '%s'", argsCount, fmtString)}
+	}
+	h := &Handler{
+		HashUint:         uint32(fields[0]),
+		IndexUint:        uint32(fields[1]),
+		FilenameHashUint: uint16(fields[2]),
+		LineNumberUint:   uint16(fields[3]),
+	}
+	h.Args.fmtString = fmtString
+	for i := uint64(0); i < argsCount; i++ {
+		fmtVerb, err := d.readUvarint()
+		if err != nil {
+			return err
+		}
+		kind, err := d.readInteger(1)
+		if err != nil {
+			return d.truncated(err)
+		}
+		size, err := d.readInteger(1)
+		if err != nil {
+			return d.truncated(err)
+		}
+		argType, ok := kindTypes[reflect.Kind(kind)]
+		if !ok {
+			return &ErrBadRecord{recordHandler, fmt.Sprintf("unsupported kind %v", reflect.Kind(kind))}
+		}
+		var writer writer = &writerString{}
+		if argType.Kind() != reflect.String {
+			writer = &writerByteArray{count: int(size)}
+		}
+		hArg := &HandlerArg{writer: writer, fmtVerb: rune(fmtVerb), decodeArg: newDecodeArg(argType)}
+		h.Args.args = append(h.Args.args, hArg)
+	}
+	if d.dictionary.Handlers == nil {
+		d.dictionary.Handlers = make(map[uint32]*Handler)
+	}
+	d.dictionary.Handlers[h.HashUint] = h
+	return nil
+}
+
+// Read unsigned varint byte by byte
+func (d *Decoder) readUvarint() (uint64, error) {
+	var value uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b, err := d.readInteger(1)
+		if err != nil {
+			return 0, d.truncated(err)
+		}
+		value |= (b & 0x7F) << shift
+		if b < 0x80 {
+			return value, nil
+		}
+	}
+	return 0, &ErrBadRecord{0, "varint overflow"}
+}
+
+// Read varint length of the string followed by the string
+func (d *Decoder) readRecordString() (string, error) {
+	count, err := d.readUvarint()
+	if err != nil {
+		return "", err
+	}
+	if count > MAX_FRAME_SIZE {
+		return "", &ErrBadRecord{0, fmt.Sprintf("string length %d", count)}
+	}
+	data := make([]byte, count)
+	if err := d.readFull(data); err != nil {
+		return "", d.truncated(err)
+	}
+	return string(data), nil
+}
+
+// If the stream starts with the stream header I take the flags, including
+// AddFrameHeader, from the stream header before I read the first frame
+// The flags of a stream header in the middle of the stream apply to the
+// frames following the stream header
+func (d *Decoder) detectStreamHeader() {
+	bufReader, ok := d.reader.(*bufio.Reader)
+	if !ok {
+		return
+	}
+	// DICTIONARY_HASH, record type, magic, version, flags
+	recordSize := 4 + 1 + 1 + len(STREAM_MAGIC) + 1 + 4
+	data, _ := bufReader.Peek(FRAME_HEADER_SIZE + recordSize)
+	addFrameHeader := false
+	if len(data) >= 2 && binary.LittleEndian.Uint16(data) == FRAME_SYNC {
+		data = data[FRAME_HEADER_SIZE:]
+		addFrameHeader = true
+	}
+	if len(data) < recordSize {
+		return
+	}
+	if binary.LittleEndian.Uint32(data) != DICTIONARY_HASH || data[4] != recordStreamHeader {
+		return
+	}
+	magic := data[5:]
+	if int(magic[0]) != len(STREAM_MAGIC) || string(magic[1:1+len(STREAM_MAGIC)]) != STREAM_MAGIC {
+		return
+	}
+	flags := binary.LittleEndian.Uint32(data[recordSize-4:])
+	d.options.setFlags(flags)
+	d.options.AddFrameHeader = addFrameHeader
+}
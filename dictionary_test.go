@@ -0,0 +1,105 @@
+package binlog
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestDictionary(t *testing.T) {
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, TimestampDummy})
+
+	binlog.Log("Hello %d %s", int8(-1), "world")
+	binlog.Log("Hello %x", uint64(1<<63))
+	var dictionaryBuf bytes.Buffer
+	if err := binlog.WriteDictionary(&dictionaryBuf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	dictionary, options, err := ReadDictionary(&dictionaryBuf)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(dictionary.Handlers) != 2 {
+		t.Fatalf("Dictionary contains %d handlers instead of 2", len(dictionary.Handlers))
+	}
+	expected := []string{"Hello -1 world", "Hello 8000000000000000"}
+	decoder := NewDecoder(&buf, dictionary, options)
+	for i := range expected {
+		if !decoder.Next() {
+			t.Fatalf("%v", decoder.Err())
+		}
+		if actual := Format(decoder.Entry()); actual != expected[i] {
+			t.Fatalf("Print failed expected '%s', actual '%s'", expected[i], actual)
+		}
+	}
+}
+
+// The dictionary is in the beginning of the binary log and the decoder
+// takes the layout from the stream header
+func TestDictionaryInStream(t *testing.T) {
+	ADD_FRAME_HEADER, ADD_FRAME_CRC, ADD_SOURCE_LINE, ADD_TIMESTAMP = true, true, true, true
+	defer func() {
+		ADD_FRAME_HEADER, ADD_FRAME_CRC, ADD_SOURCE_LINE, ADD_TIMESTAMP = false, false, false, false
+	}()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, TimestampDummy})
+
+	binlog.Log("Hello %d", 1)
+	binlog.Log("Hello %s", "world")
+	var stream bytes.Buffer
+	binlog.WriteDictionary(&stream)
+	stream.Write(buf.Bytes())
+
+	ADD_FRAME_HEADER, ADD_FRAME_CRC, ADD_SOURCE_LINE, ADD_TIMESTAMP = false, false, false, false
+	decoder := NewDecoder(&stream, nil, nil)
+	expected := []string{"Hello 1", "Hello world"}
+	for i := range expected {
+		if !decoder.Next() {
+			t.Fatalf("%v", decoder.Err())
+		}
+		logEntry := decoder.Entry()
+		if actual := Format(logEntry); actual != expected[i] {
+			t.Fatalf("Print failed expected '%s', actual '%s'", expected[i], actual)
+		}
+		if logEntry.Filename == "" || logEntry.LineNumber == 0 {
+			t.Fatalf("Missing source line %s:%d", logEntry.Filename, logEntry.LineNumber)
+		}
+	}
+	if decoder.Next() || decoder.Err() != nil {
+		t.Fatalf("Expected end of stream, got %v", decoder.Err())
+	}
+	if options := decoder.Options(); !options.AddFrameHeader || !options.AddFrameCRC {
+		t.Fatalf("Options %v do not match the stream header", options)
+	}
+}
+
+// Log() writes the dictionary records before the first use of a format string
+func TestDictionaryRecordsInBand(t *testing.T) {
+	ADD_DICTIONARY, ADD_FRAME_CRC = true, true
+	defer func() { ADD_DICTIONARY, ADD_FRAME_CRC = false, false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, TimestampDummy})
+
+	expected := []string{}
+	for i := 0; i < 3; i++ {
+		binlog.Log("Hello %d", i)
+		expected = append(expected, fmt.Sprintf("Hello %d", i))
+		binlog.Log("Hello %s", "world")
+		expected = append(expected, "Hello world")
+	}
+	decoder := NewDecoder(&buf, nil, &DecoderOptions{})
+	count := 0
+	for decoder.Next() {
+		if actual := Format(decoder.Entry()); actual != expected[count] {
+			t.Fatalf("Print failed expected '%s', actual '%s'", expected[count], actual)
+		}
+		count++
+	}
+	if decoder.Err() != nil || count != len(expected) {
+		t.Fatalf("Decoded %d entries instead of %d: %v", count, len(expected), decoder.Err())
+	}
+}
@@ -0,0 +1,202 @@
+package binlog
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// Errors returned by the decoder
+// All errors work with errors.As() and errors.Is(). For example,
+// errors.Is(err, &ErrUnknownHash{}) is true for any unknown hash
+// Clean end of the binary stream is io.EOF
+
+// ErrUnknownHash is returned if the hash of the format string is not in the index table
+type ErrUnknownHash struct {
+	Hash uint32
+}
+
+func (e *ErrUnknownHash) Error() string {
+	return fmt.Sprintf("Failed to find format string hash %x", e.Hash)
+}
+
+func (e *ErrUnknownHash) Is(target error) bool {
+	_, ok := target.(*ErrUnknownHash)
+	return ok
+}
+
+// ErrUnknownFilename is returned if the hash of the filename is not in the filenames table
+type ErrUnknownFilename struct {
+	Hash uint16
+}
+
+func (e *ErrUnknownFilename) Error() string {
+	return fmt.Sprintf("Failed to find filename with hash %x", e.Hash)
+}
+
+func (e *ErrUnknownFilename) Is(target error) bool {
+	_, ok := target.(*ErrUnknownFilename)
+	return ok
+}
+
+// ErrUnknownString is returned if the ID of an interned string argument is
+// not in the dictionary or the slot is not in the intern table, see
+// INTERN_CONST_STRINGS and INTERN_TABLE_SIZE
+type ErrUnknownString struct {
+	ID uint64
+}
+
+func (e *ErrUnknownString) Error() string {
+	return fmt.Sprintf("Failed to find string with ID %d", e.ID)
+}
+
+func (e *ErrUnknownString) Is(target error) bool {
+	_, ok := target.(*ErrUnknownString)
+	return ok
+}
+
+// ErrNoInternTable is returned by DecodeNext() if the slot of the string
+// argument was defined by a previous call. DecodeNext() does not keep the
+// intern table between the calls, use Decoder, see INTERN_TABLE_SIZE
+type ErrNoInternTable struct {
+	Slot uint64
+}
+
+func (e *ErrNoInternTable) Error() string {
+	return fmt.Sprintf("DecodeNext does not keep the intern table, slot %d, use Decoder", e.Slot)
+}
+
+func (e *ErrNoInternTable) Is(target error) bool {
+	_, ok := target.(*ErrNoInternTable)
+	return ok
+}
+
+// ErrStringTooLong is returned if the length of a string argument is
+// larger than MAX_FRAME_SIZE, likely a corrupted stream
+type ErrStringTooLong struct {
+	Length uint64
+}
+
+func (e *ErrStringTooLong) Error() string {
+	return fmt.Sprintf("String length %d is too large", e.Length)
+}
+
+func (e *ErrStringTooLong) Is(target error) bool {
+	_, ok := target.(*ErrStringTooLong)
+	return ok
+}
+
+// ErrIndexMismatch is returned if SEND_STRING_INDEX is set and the index
+// of the format string in the stream does not match the index in the handler
+type ErrIndexMismatch struct {
+	Index    uint32 // index in the binary stream
+	Expected uint32 // index in the handler
+}
+
+func (e *ErrIndexMismatch) Error() string {
+	return fmt.Sprintf("Mismatch of the format string index: %d instead of %d", e.Index, e.Expected)
+}
+
+func (e *ErrIndexMismatch) Is(target error) bool {
+	_, ok := target.(*ErrIndexMismatch)
+	return ok
+}
+
+// ErrUnsupportedType is returned if the decoder can not handle the type of the argument
+type ErrUnsupportedType struct {
+	Type reflect.Type
+}
+
+func (e *ErrUnsupportedType) Error() string {
+	return fmt.Sprintf("Can not handle type %v", e.Type)
+}
+
+func (e *ErrUnsupportedType) Is(target error) bool {
+	_, ok := target.(*ErrUnsupportedType)
+	return ok
+}
+
+// ErrTruncated is returned if the binary stream ends in the middle of a frame
+// errors.Is(err, io.ErrUnexpectedEOF) is true for ErrTruncated
+type ErrTruncated struct {
+	Offset int64 // offset of the frame in the stream, -1 if the reader is not an io.Seeker
+	Err    error
+}
+
+func (e *ErrTruncated) Error() string {
+	return fmt.Sprintf("Truncated frame at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *ErrTruncated) Unwrap() error {
+	return e.Err
+}
+
+func (e *ErrTruncated) Is(target error) bool {
+	_, ok := target.(*ErrTruncated)
+	return ok
+}
+
+// Convert EOF in the middle of the frame to ErrTruncated
+// Other errors of the reader are returned as is
+func truncated(offset int64, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &ErrTruncated{offset, io.ErrUnexpectedEOF}
+	}
+	return err
+}
+
+// ErrFrameSkipped is returned by DecodeNext if ADD_FRAME_HEADER is set and
+// the frame can not be decoded, for example the hash of the format string
+// is unknown. The application can call DecodeNext again to continue with
+// the next frame. If the CRC of the frame matches the whole frame is
+// consumed, otherwise the size can be corrupted and the decoder looks for
+// the next sync marker after the sync marker of the skipped frame
+type ErrFrameSkipped struct {
+	Skipped int   // number of bytes skipped, including the frame header if the frame is consumed
+	Err     error // the reason
+}
+
+func (e *ErrFrameSkipped) Error() string {
+	return fmt.Sprintf("Skipped %d bytes: %v", e.Skipped, e.Err)
+}
+
+func (e *ErrFrameSkipped) Unwrap() error {
+	return e.Err
+}
+
+func (e *ErrFrameSkipped) Is(target error) bool {
+	_, ok := target.(*ErrFrameSkipped)
+	return ok
+}
+
+// ErrCorruptedFrame is returned by DecodeNext if ADD_FRAME_CRC is set and
+// the checksum of the frame does not match
+type ErrCorruptedFrame struct {
+	Offset   int64 // offset of the frame in the stream, -1 if the reader is not an io.Seeker
+	CRC      uint32
+	Expected uint32
+}
+
+func (e *ErrCorruptedFrame) Error() string {
+	return fmt.Sprintf("Corrupted frame at offset %d: CRC %x instead of %x", e.Offset, e.CRC, e.Expected)
+}
+
+func (e *ErrCorruptedFrame) Is(target error) bool {
+	_, ok := target.(*ErrCorruptedFrame)
+	return ok
+}
+
+// ErrBadRecord is returned if the decoder can not parse a dictionary record
+type ErrBadRecord struct {
+	Type   uint8 // type of the record, zero if not known
+	Reason string
+}
+
+func (e *ErrBadRecord) Error() string {
+	return fmt.Sprintf("Bad dictionary record type %d: %s", e.Type, e.Reason)
+}
+
+func (e *ErrBadRecord) Is(target error) bool {
+	_, ok := target.(*ErrBadRecord)
+	return ok
+}
@@ -0,0 +1,207 @@
+package binlog
+
+import (
+	binlogio "binlog/io"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// DUMP_LOCK_TIMEOUT is how long DumpOnPanic() waits for the logger to
+// complete the frame. If the panic happened between FrameStart() and
+// FrameEnd() the goroutine holds the lock itself, I dump without the lock
+const DUMP_LOCK_TIMEOUT = 100 * time.Millisecond
+
+// FlightRecorder keeps the most recent log entries in memory
+// FlightRecorder writes nothing to the disk until the application asks for
+// a dump: on demand, on panic or on a signal. When the ring is full the
+// oldest frames are dropped
+// FlightRecorder is both the IOWriter and the WriterControl of the logger:
+//
+//	recorder := NewFlightRecorder(16 << 20)
+//	binlog := New(Config{IOWriter: recorder, WriterControl: recorder, ...})
+//	recorder.SetDictionary(binlog)
+//	defer recorder.DumpOnPanic("crash.binlog")
+//
+// The dump starts with the stream header and the dictionary
+// With INTERN_TABLE_SIZE a frame refers to the strings defined by the
+// previous frames, the ring could evict the define records. The recorder
+// starts a new intern table every half of the ring and the dump starts
+// at the oldest table in the ring
+type FlightRecorder struct {
+	mutex       sync.Mutex
+	ring        *binlogio.Ring
+	size        int
+	dictionary  DictionaryWriter
+	filename    string    // see SetDumpFile()
+	tableStarts [2]uint64 // positions of the two recent intern tables in the ring
+}
+
+func NewFlightRecorder(size int) *FlightRecorder {
+	return &FlightRecorder{ring: binlogio.NewRing(size), size: size}
+}
+
+// SetDictionary sets the source of the dictionary for the dumps
+func (f *FlightRecorder) SetDictionary(dictionary DictionaryWriter) {
+	f.mutex.Lock()
+	f.dictionary = dictionary
+	f.mutex.Unlock()
+}
+
+func (f *FlightRecorder) FrameStart(io.Writer) {
+	f.mutex.Lock()
+	f.ring.StartFrame()
+}
+
+func (f *FlightRecorder) TryFrameStart(ioWriter io.Writer, timeout time.Duration) bool {
+	if !tryLock(&f.mutex, timeout) {
+		return false
+	}
+	f.ring.StartFrame()
+	return true
+}
+
+func (f *FlightRecorder) FrameEnd(io.Writer) {
+	f.ring.EndFrame()
+	f.startInternTable()
+	f.mutex.Unlock()
+}
+
+// The next log entry starts a new intern table if the current table is
+// older than half of the ring. The frames since the previous table remain
+// in the ring
+func (f *FlightRecorder) startInternTable() {
+	resetter, ok := f.dictionary.(InternTableResetter)
+	if !ok || INTERN_TABLE_SIZE == 0 {
+		return
+	}
+	position := f.ring.Position()
+	if position-f.tableStarts[1] < uint64(f.size/2) {
+		return
+	}
+	resetter.ResetInternTable()
+	f.tableStarts = [2]uint64{f.tableStarts[1], position}
+}
+
+// Write is called between FrameStart() and FrameEnd()
+func (f *FlightRecorder) Write(data []byte) (int, error) {
+	return f.ring.Write(data)
+}
+
+func (f *FlightRecorder) GetStatistics() binlogio.RingStatistics {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.ring.GetStatistics()
+}
+
+// Dump writes the dictionary followed by the log entries in the ring
+// The log entries remain in the ring
+func (f *FlightRecorder) Dump(ioWriter io.Writer) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.dump(ioWriter)
+}
+
+// The ring contains only the complete frames, the dump does not include
+// the current frame. The dump skips the frames before the oldest intern
+// table, the frames could refer to the evicted define records
+func (f *FlightRecorder) dump(ioWriter io.Writer) error {
+	if f.dictionary != nil {
+		if err := f.dictionary.WriteDictionary(ioWriter); err != nil {
+			return err
+		}
+	}
+	position := f.ring.Head()
+	for _, tableStart := range f.tableStarts {
+		if tableStart >= position {
+			position = tableStart
+			break
+		}
+	}
+	_, err := f.ring.WriteFrom(ioWriter, position)
+	return err
+}
+
+// DumpToFile creates the file and dumps the log entries
+func (f *FlightRecorder) DumpToFile(filename string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.dumpToFile(filename)
+}
+
+func (f *FlightRecorder) dumpToFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = f.dump(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// SetDumpFile sets the file for Flush(). The panic and signal hook calls
+// Flush() for the registered loggers, see Register()
+func (f *FlightRecorder) SetDumpFile(filename string) {
+	f.mutex.Lock()
+	f.filename = filename
+	f.mutex.Unlock()
+}
+
+// Flush dumps the log entries to the file set by SetDumpFile()
+func (f *FlightRecorder) Flush() error {
+	f.mutex.Lock()
+	filename := f.filename
+	f.mutex.Unlock()
+	if filename == "" {
+		return nil
+	}
+	return f.DumpToFile(filename)
+}
+
+// DumpOnPanic dumps the log entries to the file and panics again
+// The application calls DumpOnPanic() in a defer statement
+func (f *FlightRecorder) DumpOnPanic(filename string) {
+	if r := recover(); r != nil {
+		locked := tryLock(&f.mutex, DUMP_LOCK_TIMEOUT)
+		if err := f.dumpToFile(filename); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to dump the flight recorder: %v\n", err)
+		}
+		if locked {
+			f.mutex.Unlock()
+		}
+		panic(r)
+	}
+}
+
+// DumpOnSignal dumps the log entries every time the process gets one of
+// the signals, for example, syscall.SIGUSR1. The process keeps running
+// Call the returned function to stop
+func (f *FlightRecorder) DumpOnSignal(filename string, signals ...os.Signal) (stop func()) {
+	signalChannel := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signalChannel, signals...)
+	go func() {
+		for {
+			select {
+			case <-signalChannel:
+				if err := f.DumpToFile(filename); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to dump the flight recorder: %v\n", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(signalChannel)
+			close(done)
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package binlog
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func decodeFlightRecorder(t *testing.T, data []byte) []string {
+	decoder := NewDecoder(bytes.NewReader(data), nil, &DecoderOptions{})
+	logs := []string{}
+	for decoder.Next() {
+		logs = append(logs, Format(decoder.Entry()))
+	}
+	if err := decoder.Err(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return logs
+}
+
+func TestFlightRecorder(t *testing.T) {
+	recorder := NewFlightRecorder(1024)
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: recorder, WriterControl: recorder, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	recorder.SetDictionary(binlog)
+	for i := 0; i < 1000; i++ {
+		binlog.Log("Hello %d", i)
+		binlog.Log("Hello %s %d", "world", i)
+	}
+	var buf bytes.Buffer
+	if err := recorder.Dump(&buf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	logs := decodeFlightRecorder(t, buf.Bytes())
+	if len(logs) < 10 {
+		t.Fatalf("Only %d logs in the dump", len(logs))
+	}
+	if last := logs[len(logs)-1]; last != "Hello world 999" {
+		t.Fatalf("Last log is '%s'", last)
+	}
+	if statistics := recorder.GetStatistics(); statistics.Evicted == 0 {
+		t.Fatalf("Unexpected statistics %v", statistics)
+	}
+}
+
+// The ring evicts the define records of the interned strings, the dump
+// starts at the intern table in the ring
+func TestFlightRecorderInternTable(t *testing.T) {
+	INTERN_TABLE_SIZE = 4
+	defer func() { INTERN_TABLE_SIZE = 0 }()
+	recorder := NewFlightRecorder(1024)
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: recorder, WriterControl: recorder, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	recorder.SetDictionary(binlog)
+	for i := 0; i < 1000; i++ {
+		binlog.Log("GET %s %d", fmt.Sprintf("/api/users/%d", i%3), i)
+		// The dump starts a new intern table, I dump once in a while
+		if i%97 != 0 && i != 999 {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := recorder.Dump(&buf); err != nil {
+			t.Fatalf("%v", err)
+		}
+		logs := decodeFlightRecorder(t, buf.Bytes())
+		if expected := fmt.Sprintf("GET /api/users/%d %d", i%3, i); len(logs) == 0 || logs[len(logs)-1] != expected {
+			t.Fatalf("Last log is not '%s' in %v", expected, logs)
+		}
+		if i > 0 && len(logs) < 10 {
+			t.Fatalf("Only %d logs in the dump", len(logs))
+		}
+	}
+	if statistics := binlog.GetStatistics(); statistics.InternHit == 0 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+}
+
+func TestFlightRecorderDumpOnPanic(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "crash.binlog")
+	recorder := NewFlightRecorder(1024)
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: recorder, WriterControl: recorder, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	recorder.SetDictionary(binlog)
+
+	func() {
+		defer func() { recover() }()
+		defer recorder.DumpOnPanic(filename)
+		binlog.Log("Hello %d", 1)
+		panic("Crash")
+	}()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if logs := decodeFlightRecorder(t, data); len(logs) != 1 || logs[0] != "Hello 1" {
+		t.Fatalf("Unexpected dump %v", logs)
+	}
+}
+
+func TestFlightRecorderDumpOnSignal(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dump.binlog")
+	recorder := NewFlightRecorder(1024)
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: recorder, WriterControl: recorder, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	recorder.SetDictionary(binlog)
+	stop := recorder.DumpOnSignal(filename, os.Interrupt)
+	defer stop()
+
+	binlog.Log("Hello %d", 2)
+	process, _ := os.FindProcess(os.Getpid())
+	process.Signal(os.Interrupt)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+		if logs := decodeFlightRecorder(t, data); len(logs) == 1 && logs[0] == "Hello 2" {
+			return
+		}
+	}
+	t.Fatalf("Dump %s is missing", filename)
+}
+
+// The panic between FrameStart() and FrameEnd(), the goroutine holds the
+// lock of the flight recorder
+func TestFlightRecorderDumpOnPanicInFrame(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "crash.binlog")
+	recorder := NewFlightRecorder(1024)
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: recorder, WriterControl: recorder, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	recorder.SetDictionary(binlog)
+
+	func() {
+		defer func() { recover() }()
+		defer recorder.DumpOnPanic(filename)
+		binlog.Log("Hello %d", 1)
+		recorder.FrameStart(recorder)
+		recorder.Write([]byte{1, 2, 3})
+		panic("Crash")
+	}()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if logs := decodeFlightRecorder(t, data); len(logs) != 1 || logs[0] != "Hello 1" {
+		t.Fatalf("Unexpected dump %v", logs)
+	}
+}
@@ -0,0 +1,229 @@
+package binlog
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Follower decodes a binary log file while the logger is writing the file,
+// like "tail -f"
+// At the end of the file, including a partially written frame, Follower
+// waits for more data. If the file is truncated Follower starts from the
+// beginning of the file. If the file is rotated (renamed or removed and
+// created again) Follower decodes the rest of the old file and continues
+// with the new file
+//
+// Typical usage is
+//
+//	follower, err := NewFollower(filename, nil, nil)
+//	for follower.Next() {
+//		fmt.Println(Format(follower.Entry()))
+//	}
+//	err = follower.Err()
+//
+// The logger shall set ADD_DICTIONARY if the dictionary is nil
+type Follower struct {
+	// How often Follower checks the file at the end of the file
+	PollInterval time.Duration
+
+	filename   string
+	file       *os.File
+	offset     int64 // offset of the next frame in the file
+	decoder    *Decoder
+	dictionary *Dictionary
+	err        error
+
+	// The decoder of the next frame continues with the state of the stream
+	options     DecoderOptions
+	version     uint8
+	properties  map[string]string
+	internTable map[uint64]string
+
+	statistics FollowerStatistics
+
+	mutex     sync.Mutex // protects the file in Close()
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type FollowerStatistics struct {
+	Truncated uint64 // the file was truncated
+	Rotated   uint64 // the file was replaced by a new file
+	Retries   uint64 // partial frames at the end of the file
+}
+
+// NewFollower opens the file and starts decoding from the beginning of the file
+// See NewDecoder() for dictionary and options
+func NewFollower(filename string, dictionary *Dictionary, options *DecoderOptions) (*Follower, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if options == nil {
+		defaultOptions := DefaultDecoderOptions()
+		options = &defaultOptions
+	}
+	if dictionary == nil {
+		dictionary = NewDictionary()
+	}
+	return &Follower{
+		PollInterval: 100 * time.Millisecond,
+		filename:     filename,
+		file:         file,
+		dictionary:   dictionary,
+		options:      *options,
+		internTable:  make(map[uint64]string),
+		done:         make(chan struct{}),
+	}, nil
+}
+
+// Next blocks until the next log entry, see Entry()
+// Next returns false after Close() or on error, see Err(). The application
+// can call Next() again after an error, for example ErrFrameSkipped
+func (f *Follower) Next() bool {
+	f.err = nil
+	for {
+		if f.decoder == nil {
+			if err := f.startDecoder(); err != nil {
+				return f.stop(err)
+			}
+		}
+		if f.decoder.Next() {
+			return true
+		}
+		err := f.decoder.Err()
+		if err != nil && !errors.Is(err, &ErrTruncated{}) {
+			return f.stop(err)
+		}
+		// The end of the file or a partial frame. I will decode the frame
+		// again when the logger completes the frame
+		if err != nil {
+			f.offset = f.decoder.frameOffset
+			f.statistics.Retries++
+		} else {
+			f.offset = f.decoder.Offset()
+		}
+		f.options, f.version, f.properties = f.decoder.options, f.decoder.version, f.decoder.properties
+		f.decoder = nil
+		if err := f.wait(); err != nil {
+			return f.stop(err)
+		}
+	}
+}
+
+// Entry returns the log entry decoded by Next()
+// The log entry, including the arguments, is valid until the next call to Next()
+func (f *Follower) Entry() *LogEntry {
+	return f.decoder.Entry()
+}
+
+// Err returns the error which stopped Next(), nil after Close()
+func (f *Follower) Err() error {
+	return f.err
+}
+
+func (f *Follower) GetStatistics() FollowerStatistics {
+	return f.statistics
+}
+
+// Close stops Next() and closes the file
+// The application can call Close() from another goroutine
+func (f *Follower) Close() error {
+	var err error
+	f.closeOnce.Do(func() {
+		close(f.done)
+		f.mutex.Lock()
+		err = f.file.Close()
+		f.mutex.Unlock()
+	})
+	return err
+}
+
+func (f *Follower) isClosed() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns false, ignores the error after Close()
+func (f *Follower) stop(err error) bool {
+	if f.isClosed() {
+		err = nil
+	}
+	f.err = err
+	return false
+}
+
+// Create a decoder reading from the offset of the next frame
+// The decoder keeps the dictionary, the stream header and the intern table
+func (f *Follower) startDecoder() error {
+	if _, err := f.file.Seek(f.offset, io.SeekStart); err != nil {
+		return err
+	}
+	f.decoder = newDecoder(bufio.NewReader(f.file), f.offset, f.dictionary, f.options)
+	f.decoder.version, f.decoder.properties = f.version, f.properties
+	f.decoder.internTable = f.internTable
+	return nil
+}
+
+// The new file starts a new stream
+func (f *Follower) resetStream() {
+	f.version, f.properties = 0, nil
+	for slot := range f.internTable {
+		delete(f.internTable, slot)
+	}
+}
+
+// Wait until the file grows, is truncated or rotated
+func (f *Follower) wait() error {
+	for {
+		select {
+		case <-f.done:
+			return io.EOF
+		case <-time.After(f.PollInterval):
+		}
+		fileInfo, err := f.file.Stat()
+		if err != nil {
+			return err
+		}
+		if fileInfo.Size() < f.offset {
+			f.offset = 0
+			f.resetStream()
+			f.statistics.Truncated++
+			return nil
+		}
+		if fileInfo.Size() > f.offset {
+			return nil
+		}
+		// No new data in the file, check if there is a new file
+		// The new file can be missing for a short while
+		pathInfo, err := os.Stat(f.filename)
+		if err != nil || os.SameFile(fileInfo, pathInfo) {
+			continue
+		}
+		file, err := os.Open(f.filename)
+		if err != nil {
+			continue
+		}
+		f.mutex.Lock()
+		if f.isClosed() {
+			f.mutex.Unlock()
+			file.Close()
+			return io.EOF
+		}
+		f.file.Close()
+		f.file = file
+		f.mutex.Unlock()
+		f.offset = 0
+		f.resetStream()
+		f.statistics.Rotated++
+		return nil
+	}
+}
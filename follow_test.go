@@ -0,0 +1,150 @@
+package binlog
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Call Next() in a goroutine, the test writes the file meanwhile
+func followerNext(follower *Follower) chan string {
+	result := make(chan string, 1)
+	go func() {
+		if follower.Next() {
+			result <- Format(follower.Entry())
+		} else {
+			result <- fmt.Sprintf("Next failed %v", follower.Err())
+		}
+	}()
+	return result
+}
+
+func expectFollowerEntry(t *testing.T, result chan string, expected string) {
+	select {
+	case actual := <-result:
+		if actual != expected {
+			t.Fatalf("Print failed expected '%s', actual '%s'", expected, actual)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for '%s'", expected)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	ADD_DICTIONARY, ADD_FRAME_HEADER = true, true
+	defer func() { ADD_DICTIONARY, ADD_FRAME_HEADER = false, false }()
+	filename := filepath.Join(t.TempDir(), "binlog")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer func() { file.Close() }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, TimestampDummy})
+
+	follower, err := NewFollower(filename, nil, &DecoderOptions{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer follower.Close()
+	follower.PollInterval = time.Millisecond
+
+	for i := 0; i < 3; i++ {
+		binlog.Log("Hello %d", i)
+		file.Write(buf.Bytes())
+		buf.Reset()
+		expectFollowerEntry(t, followerNext(follower), fmt.Sprintf("Hello %d", i))
+	}
+
+	// Partial frame, the follower waits for the rest of the frame
+	binlog.Log("Hello %s", "world")
+	result := followerNext(follower)
+	file.Write(buf.Bytes()[:buf.Len()-2])
+	select {
+	case actual := <-result:
+		t.Fatalf("Unexpected '%s' for a partial frame", actual)
+	case <-time.After(20 * time.Millisecond):
+	}
+	file.Write(buf.Bytes()[buf.Len()-2:])
+	buf.Reset()
+	expectFollowerEntry(t, result, "Hello world")
+
+	// Truncated file, a new logger writes the dictionary again
+	binlog = New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, TimestampDummy})
+	binlog.Log("Truncated %d", 1)
+	file.Truncate(0)
+	file.Seek(0, 0)
+	file.Write(buf.Bytes())
+	buf.Reset()
+	expectFollowerEntry(t, followerNext(follower), "Truncated 1")
+	if statistics := follower.GetStatistics(); statistics.Truncated != 1 || statistics.Retries == 0 {
+		t.Fatalf("Unexpected statistics %v", statistics)
+	}
+
+	// Rotated file: the follower reads the rest of the old file first
+	binlog.Log("Old file %d", 2)
+	file.Write(buf.Bytes())
+	buf.Reset()
+	file.Close()
+	os.Rename(filename, filename+".1")
+	file, err = os.Create(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	binlog = New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, TimestampDummy})
+	binlog.Log("New file %d", 3)
+	file.Write(buf.Bytes())
+	buf.Reset()
+	expectFollowerEntry(t, followerNext(follower), "Old file 2")
+	expectFollowerEntry(t, followerNext(follower), "New file 3")
+	if statistics := follower.GetStatistics(); statistics.Rotated != 1 {
+		t.Fatalf("Unexpected statistics %v", statistics)
+	}
+
+	// Close() stops Next()
+	result = followerNext(follower)
+	follower.Close()
+	expectFollowerEntry(t, result, "Next failed <nil>")
+}
+
+// Every Next() at the end of the file starts a new decoder, the decoder
+// keeps the interned strings
+func TestFollowerInternTable(t *testing.T) {
+	ADD_DICTIONARY, ADD_FRAME_HEADER, INTERN_TABLE_SIZE = true, true, 4
+	defer func() { ADD_DICTIONARY, ADD_FRAME_HEADER, INTERN_TABLE_SIZE = false, false, 0 }()
+	filename := filepath.Join(t.TempDir(), "binlog")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer file.Close()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{&buf, &WriterControlDummy{}, constDataBase, constDataSize, TimestampDummy})
+	binlog.WriteDictionary(&buf)
+
+	follower, err := NewFollower(filename, nil, &DecoderOptions{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer follower.Close()
+	follower.PollInterval = time.Millisecond
+
+	path := fmt.Sprintf("/api/%s", "users")
+	for i := 0; i < 3; i++ {
+		// The follower reaches the end of the file before the log entry
+		result := followerNext(follower)
+		time.Sleep(10 * time.Millisecond)
+		binlog.Log("GET %s %d", path, i)
+		file.Write(buf.Bytes())
+		buf.Reset()
+		expectFollowerEntry(t, result, fmt.Sprintf("GET /api/users %d", i))
+	}
+	if statistics := binlog.GetStatistics(); statistics.InternHit != 2 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+}
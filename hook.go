@@ -0,0 +1,178 @@
+package binlog
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MARKER_FMT_STRING is the format string of the marker log entry: reason,
+// message and the stack
+const MARKER_FMT_STRING = "%s: %s\n%s"
+
+// MARKER_LOCK_TIMEOUT is how long WriteMarker() waits for the logger to
+// complete the frame. If the panic happened between FrameStart() and
+// FrameEnd() the goroutine holds the lock itself and WriteMarker() fails
+const MARKER_LOCK_TIMEOUT = 100 * time.Millisecond
+
+// The record type, the timestamp, the lengths of the strings and two
+// truncation markers
+const markerOverhead = 128
+
+// The loggers the hook flushes
+var registry struct {
+	sync.Mutex
+	loggers []*Binlog
+}
+
+// Register adds the logger to the loggers RecoverAndFlush() and the signal
+// handler flush. The hooks write the marker while other goroutines call
+// Log(), the WriterControl of the logger shall be a LockingWriterControl
+func Register(b *Binlog) error {
+	if _, ok := b.config.WriterControl.(LockingWriterControl); !ok {
+		return fmt.Errorf("WriterControl %T does not lock the frames", b.config.WriterControl)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	for _, logger := range registry.loggers {
+		if logger == b {
+			return nil
+		}
+	}
+	registry.loggers = append(registry.loggers, b)
+	return nil
+}
+
+func Unregister(b *Binlog) {
+	registry.Lock()
+	defer registry.Unlock()
+	for i, logger := range registry.loggers {
+		if logger == b {
+			registry.loggers = append(registry.loggers[:i], registry.loggers[i+1:]...)
+			return
+		}
+	}
+}
+
+// FlushAll writes the marker to all registered loggers. See WriteMarker()
+func FlushAll(reason string, message string, stack string) error {
+	registry.Lock()
+	loggers := append([]*Binlog{}, registry.loggers...)
+	registry.Unlock()
+	var err error
+	for _, b := range loggers {
+		if markerErr := b.WriteMarker(reason, message, stack); markerErr != nil && err == nil {
+			err = markerErr
+		}
+	}
+	return err
+}
+
+// RecoverAndFlush writes the panic message and the stack to all registered
+// loggers and panics again. The application calls RecoverAndFlush() in a
+// defer statement, for example, in main() and in the goroutines:
+//
+//	binlog.Register(logger)
+//	defer binlog.RecoverAndFlush()
+func RecoverAndFlush() {
+	if r := recover(); r != nil {
+		if err := FlushAll("panic", fmt.Sprint(r), string(debug.Stack())); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to flush the logs: %v\n", err)
+		}
+		panic(r)
+	}
+}
+
+// InstallSignalHandler flushes all registered loggers when the process
+// gets one of the signals, SIGTERM and SIGQUIT by default. After the flush
+// the handler restores the default action and sends the signal again: the
+// process terminates as if there was no handler
+// Call the returned function to remove the handler
+func InstallSignalHandler(signals ...os.Signal) (stop func()) {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGTERM, syscall.SIGQUIT}
+	}
+	signalChannel := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signalChannel, signals...)
+	go func() {
+		select {
+		case sig := <-signalChannel:
+			// Stacks of all goroutines like the default SIGQUIT handler
+			stack := make([]byte, 1<<20)
+			stack = stack[:runtime.Stack(stack, true)]
+			if err := FlushAll("signal", sig.String(), string(stack)); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to flush the logs: %v\n", err)
+			}
+			signal.Reset(signals...)
+			if process, err := os.FindProcess(os.Getpid()); err == nil {
+				process.Signal(sig)
+			}
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(signalChannel)
+			close(done)
+		})
+	}
+}
+
+// WriteMarker writes the stream header, the dictionary and the marker and
+// flushes the IOWriter. The decoder returns the marker as a log entry with
+// LogEntry.Marker set. The binary stream is decodable without the logger
+// If the IOWriter has Flush() or Sync(), for example, bufio.Writer or
+// os.File, WriteMarker calls the method
+// WriteMarker is thread safe with Log() only if the WriterControl is a
+// LockingWriterControl. The long stack is truncated, the marker fits in a
+// frame
+func (b *Binlog) WriteMarker(reason string, message string, stack string) error {
+	var timestamp int64
+	if b.config.Timestamp != nil {
+		timestamp = b.config.Timestamp()
+	}
+	room := MAX_FRAME_SIZE - markerOverhead - len(reason)
+	message = truncateMarkerString(message, room)
+	stack = truncateMarkerString(stack, room-len(message))
+	if locking, ok := b.config.WriterControl.(LockingWriterControl); ok {
+		if !locking.TryFrameStart(b.config.IOWriter, MARKER_LOCK_TIMEOUT) {
+			return fmt.Errorf("Failed to lock the logger in %v", MARKER_LOCK_TIMEOUT)
+		}
+	} else {
+		b.config.WriterControl.FrameStart(b.config.IOWriter)
+	}
+	err := b.WriteDictionary(b.config.IOWriter)
+	if err == nil {
+		err = writeRecord(b.config.IOWriter, encodeMarker(timestamp, reason, message, stack))
+	}
+	b.config.WriterControl.FrameEnd(b.config.IOWriter)
+	if err != nil {
+		return err
+	}
+	if flusher, ok := b.config.IOWriter.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+	if syncer, ok := b.config.IOWriter.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+func truncateMarkerString(s string, room int) string {
+	if room < 0 {
+		room = 0
+	}
+	if len(s) <= room {
+		return s
+	}
+	return s[:room] + fmt.Sprintf(TRUNCATED_FMT, len(s)-room)
+}
@@ -0,0 +1,181 @@
+package binlog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The dictionary is in the end of the binary stream
+func decodeWithMarker(t *testing.T, data []byte) ([]string, *LogEntry) {
+	dictionary, options, err := ScanDictionary(bytes.NewReader(data), &DecoderOptions{AddFrameHeader: true})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	decoder := NewDecoder(bytes.NewReader(data), dictionary, options)
+	logs := []string{}
+	var marker *LogEntry
+	for decoder.Next() {
+		if decoder.Entry().Marker {
+			logEntry := *decoder.Entry()
+			marker = &logEntry
+			continue
+		}
+		logs = append(logs, Format(decoder.Entry()))
+	}
+	if err := decoder.Err(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return logs, marker
+}
+
+func TestRecoverAndFlush(t *testing.T) {
+	ADD_FRAME_HEADER = true
+	defer func() { ADD_FRAME_HEADER = false }()
+	var buf bytes.Buffer
+	// Nothing reaches the buffer without a flush
+	bufWriter := bufio.NewWriterSize(&buf, 64<<10)
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: bufWriter, WriterControl: &WriterControlMutex{}, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	if err := Register(binlog); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer Unregister(binlog)
+
+	func() {
+		defer func() { recover() }()
+		defer RecoverAndFlush()
+		binlog.Log("Hello %d", 1)
+		panic("Crash")
+	}()
+	logs, marker := decodeWithMarker(t, buf.Bytes())
+	if len(logs) != 1 || logs[0] != "Hello 1" {
+		t.Fatalf("Unexpected logs %v", logs)
+	}
+	if marker == nil || !strings.HasPrefix(Format(marker), "panic: Crash\n") || !strings.Contains(Format(marker), "TestRecoverAndFlush") {
+		t.Fatalf("Unexpected marker %v", marker)
+	}
+}
+
+// The child process gets SIGTERM with unflushed logs
+func TestSignalHandler(t *testing.T) {
+	if filename := os.Getenv("BINLOG_SIGNAL_FILE"); filename != "" {
+		ADD_FRAME_HEADER = true
+		file, _ := os.Create(filename)
+		bufWriter := bufio.NewWriterSize(file, 64<<10)
+		constDataBase, constDataSize := GetSelfTextAddressSize()
+		binlog := New(Config{IOWriter: bufWriter, WriterControl: &WriterControlMutex{}, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+		Register(binlog)
+		InstallSignalHandler()
+		binlog.Log("Hello %d", 2)
+		process, _ := os.FindProcess(os.Getpid())
+		process.Signal(syscall.SIGTERM)
+		time.Sleep(5 * time.Second)
+		os.Exit(0)
+	}
+	filename := filepath.Join(t.TempDir(), "binlog")
+	cmd := exec.Command(os.Args[0], "-test.run=TestSignalHandler")
+	cmd.Env = append(os.Environ(), "BINLOG_SIGNAL_FILE="+filename)
+	cmd.Run()
+	if state := cmd.ProcessState; state == nil || state.Sys().(syscall.WaitStatus).Signal() != syscall.SIGTERM {
+		t.Fatalf("Child process was not terminated: %v", state)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	logs, marker := decodeWithMarker(t, data)
+	if len(logs) != 1 || logs[0] != "Hello 2" {
+		t.Fatalf("Unexpected logs %v", logs)
+	}
+	if marker == nil || !strings.HasPrefix(Format(marker), "signal: terminated\n") {
+		t.Fatalf("Unexpected marker %v", marker)
+	}
+}
+
+// The hooks write the markers from other goroutines
+func TestRegisterWithoutLock(t *testing.T) {
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: &buf, WriterControl: &WriterControlDummy{}, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	if err := Register(binlog); err == nil {
+		Unregister(binlog)
+		t.Fatalf("Registered the logger with WriterControlDummy")
+	}
+}
+
+// The panic between FrameStart() and FrameEnd() does not deadlock
+func TestRecoverAndFlushInFrame(t *testing.T) {
+	var buf bytes.Buffer
+	writerControl := &WriterControlMutex{}
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: &buf, WriterControl: writerControl, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	if err := Register(binlog); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer Unregister(binlog)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() { recover() }()
+		defer RecoverAndFlush()
+		writerControl.FrameStart(&buf)
+		panic("Crash")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("RecoverAndFlush() deadlocked")
+	}
+}
+
+// The marker with a huge stack fits in a frame
+func TestWriteMarkerLongStack(t *testing.T) {
+	ADD_FRAME_HEADER = true
+	defer func() { ADD_FRAME_HEADER = false }()
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: &buf, WriterControl: &WriterControlMutex{}, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	binlog.Log("Hello %d", 1)
+	stack := strings.Repeat("goroutine 1 [running]:\n", 2*MAX_FRAME_SIZE/23)
+	if err := binlog.WriteMarker("signal", "terminated", stack); err != nil {
+		t.Fatalf("%v", err)
+	}
+	logs, marker := decodeWithMarker(t, buf.Bytes())
+	if len(logs) != 1 || marker == nil || !strings.Contains(Format(marker), "bytes truncated]") {
+		t.Fatalf("Unexpected logs %v, marker %v", logs, marker != nil)
+	}
+}
+
+// FlushAll() while other goroutines add format strings
+func TestFlushAllConcurrent(t *testing.T) {
+	var buf bytes.Buffer
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: &buf, WriterControl: &WriterControlMutex{}, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	if err := Register(binlog); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer Unregister(binlog)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			binlog.Log(fmt.Sprintf("Request %d %%d", i), i)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err := FlushAll("signal", "terminated", ""); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	wg.Wait()
+}
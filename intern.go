@@ -0,0 +1,232 @@
+package binlog
+
+import (
+	"encoding/binary"
+	"io"
+	"reflect"
+)
+
+// INTERN_CONST_STRINGS enables interning of the string arguments which are
+// literals in the executable, for example, names of the errors or states.
+// The logger adds the string to the dictionary and writes the ID of the
+// string instead of the string. The check is the same as for the format
+// strings: the address of the string is in the const data
+var INTERN_CONST_STRINGS = false
+
+type constString struct {
+	value string
+	id    uint64
+	next  *constString // the next string with the same address and a different length
+}
+
+// stringRef is a string argument Log() writes as an ID
+type stringRef struct {
+	kind int // stringPlain if the string is not interned
+	id   uint64
+}
+
+// Collect the interned strings of the log entry in b.stringRefs
+func (b *Binlog) internStrings(h *Handler, args []interface{}) []stringRef {
+	b.stringRefs = b.stringRefs[:0]
+	if b.internTable.reset {
+		b.internTable = internTable{stamp: b.internTable.stamp, reset: true}
+	}
+	b.internTable.stamp++
+	for i, arg := range args {
+		var ref stringRef
+		if h.Args.args[i].decodeArg.argKind == reflect.String {
+			ref = b.getStringRef(*(*string)(getInterfaceData(arg)))
+		}
+		b.stringRefs = append(b.stringRefs, ref)
+	}
+	return b.stringRefs
+}
+
+// The const strings do not require the define records, I try them first
+func (b *Binlog) getStringRef(value string) stringRef {
+	if INTERN_CONST_STRINGS {
+		if s := b.getConstString(value); s != nil {
+			return stringRef{stringInterned, s.id}
+		}
+	}
+	if INTERN_TABLE_SIZE > 0 {
+		if e := b.getInternedString(value); e != nil {
+			return stringRef{stringDynamic, e.slot}
+		}
+	}
+	return stringRef{kind: stringPlain}
+}
+
+// Returns nil if the string is not in the const data
+func (b *Binlog) getConstString(value string) *constString {
+	if len(value) == 0 || len(value) > getMaxStringLength() || b.getStringOffset(value) >= b.config.ConstDataSize {
+		return nil
+	}
+	address := getStringAddress(value)
+	head := b.constStrings[uintptr(address)]
+	for s := head; s != nil; s = s.next {
+		if len(s.value) == len(value) {
+			b.statistics.ConstStringHit++
+			return s
+		}
+	}
+	b.statistics.ConstStringMiss++
+	s := &constString{value: value, id: uint64(len(b.constStringsByID)), next: head}
+	b.constStrings[uintptr(address)] = s
+	b.constStringsByID = append(b.constStringsByID, s)
+	b.stringsByID[s.id] = value
+	if ADD_DICTIONARY {
+		b.pendingStrings = append(b.pendingStrings, s)
+	}
+	b.dictionaryVersion++
+	return s
+}
+
+func getStringRefSize(ref stringRef) int {
+	var header [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(header[:], ref.id<<2|uint64(ref.kind))
+}
+
+func writeStringRef(ioWriter io.Writer, ref stringRef) {
+	var header [binary.MaxVarintLen64]byte
+	ioWriter.Write(header[:binary.PutUvarint(header[:], ref.id<<2|uint64(ref.kind))])
+}
+
+// INTERN_TABLE_SIZE enables interning of the runtime strings, for example,
+// HTTP paths or host names. The logger keeps up to INTERN_TABLE_SIZE
+// recently used strings in a table. The first time the logger sees a string
+// the logger writes a define record (slot, string) before the log entry.
+// The following log entries contain the slot of the string instead of the
+// string. If the table is full the logger reuses the slot of the least
+// recently used string. The decoder keeps the same table
+// The define records are part of the stream, not of the dictionary. A
+// decoder which missed a define record would decode the previous string of
+// the slot. WriteDictionary() starts a new table: the next log entry writes
+// the reset record and defines the strings again. The sinks write the
+// dictionary when the decoder can start, for example, a new file of
+// RotatingFile or a new connection of NetworkSink. NetworkSink calls
+// ResetInternTable() if the sink drops frames or loses the connection with
+// the backlog. FlightRecorder starts a new table every half of the ring.
+// The decoder which missed the define record fails with ErrUnknownString
+// until the reset record
+// DecodeNext() does not keep the table between the calls, use Decoder
+var INTERN_TABLE_SIZE = 0
+
+// Shorter strings are cheaper to write than to look up
+const INTERN_MIN_LENGTH = 4
+
+// internTable is a map of the strings and a list of the strings in the
+// order of use
+type internTable struct {
+	entries map[string]*internEntry
+	head    *internEntry // the most recently used string
+	tail    *internEntry // the least recently used string
+	size    uint64       // slots in use
+	stamp   uint64       // incremented by every Log()
+	reset   bool         // the next log entry starts a new table, see ResetInternTable()
+}
+
+type internEntry struct {
+	value string
+	slot  uint64
+	stamp uint64 // the last Log() which used the string
+	prev  *internEntry
+	next  *internEntry
+}
+
+func (t *internTable) remove(e *internEntry) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		t.head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		t.tail = e.prev
+	}
+	e.prev, e.next = nil, nil
+}
+
+func (t *internTable) pushFront(e *internEntry) {
+	e.next = t.head
+	if t.head != nil {
+		t.head.prev = e
+	} else {
+		t.tail = e
+	}
+	t.head = e
+}
+
+// Returns nil if the string is too short or too long or if all strings
+// in the table are arguments of the current log entry
+func (b *Binlog) getInternedString(value string) *internEntry {
+	if len(value) < INTERN_MIN_LENGTH || len(value) > getMaxStringLength() {
+		return nil
+	}
+	t := &b.internTable
+	if e, ok := t.entries[value]; ok {
+		b.statistics.InternHit++
+		e.stamp = t.stamp
+		if t.head != e {
+			t.remove(e)
+			t.pushFront(e)
+		}
+		return e
+	}
+	var e *internEntry
+	if t.size < uint64(INTERN_TABLE_SIZE) {
+		e = &internEntry{slot: t.size}
+		t.size++
+	} else {
+		// The current log entry can not reuse a slot it refers to
+		e = t.tail
+		if e == nil || e.stamp == t.stamp {
+			return nil
+		}
+		t.remove(e)
+		delete(t.entries, e.value)
+		b.statistics.InternEvicted++
+	}
+	b.statistics.InternMiss++
+	if t.entries == nil {
+		t.entries = make(map[string]*internEntry)
+	}
+	// The application can reuse the memory of the string, I keep a copy
+	e.value = string([]byte(value))
+	e.stamp = t.stamp
+	t.entries[e.value] = e
+	t.pushFront(e)
+	b.pendingDefines = append(b.pendingDefines, e)
+	return e
+}
+
+// ResetInternTable starts a new intern table. The next log entry writes
+// the reset record, the decoder drops the strings it has. Call
+// ResetInternTable() if the decoder could miss a define record, for
+// example, the sink dropped a frame. ResetInternTable() is not thread safe
+// with Log(), the sinks call ResetInternTable() under the lock
+func (b *Binlog) ResetInternTable() {
+	if INTERN_TABLE_SIZE > 0 {
+		b.internTable.reset = true
+	}
+}
+
+// InternTableResetter is a DictionaryWriter with an intern table, for
+// example, *Binlog, see INTERN_TABLE_SIZE
+type InternTableResetter interface {
+	ResetInternTable()
+}
+
+// Write the reset record if the table is new and the define records of the
+// strings the current log entry added to the table
+func (b *Binlog) writeDefineRecords() {
+	if b.internTable.reset {
+		writeRecord(b.config.IOWriter, encodeResetStrings())
+		b.internTable.reset = false
+	}
+	for _, e := range b.pendingDefines {
+		writeRecord(b.config.IOWriter, encodeDefineString(e.slot, e.value))
+	}
+	b.pendingDefines = b.pendingDefines[:0]
+}
@@ -0,0 +1,164 @@
+package io
+
+import (
+	"encoding/binary"
+	stdio "io"
+)
+
+// Ring is a cyclic buffer of frames, for example, log entries
+// When the ring is full Ring drops the oldest frames. Ring never splits a
+// frame: a reader gets only complete frames
+// Every frame in the ring is prefixed by 32 bits length
+// The positions are running counters, the offset in the ring is position % size
+// Ring is not thread safe
+// I do not use Fifo here: Fifo moves single bytes and has no notion of a
+// frame, the ring needs bulk copies and eviction of whole frames
+type Ring struct {
+	data       []byte
+	head       uint64 // position of the oldest frame
+	frameStart uint64 // position of the length of the current frame
+	tail       uint64 // position of the next byte
+	inFrame    bool
+	overflow   bool // the current frame is larger than the ring
+	statistics RingStatistics
+}
+
+type RingStatistics struct {
+	Frames  uint64 // complete frames
+	Evicted uint64 // frames dropped to make room for new frames
+	Dropped uint64 // frames larger than the ring
+}
+
+const ringFrameHeaderSize = 4
+
+func NewRing(size int) *Ring {
+	return &Ring{data: make([]byte, size)}
+}
+
+// StartFrame starts a new frame. StartFrame drops an incomplete frame
+func (r *Ring) StartFrame() {
+	r.tail = r.frameStart
+	r.inFrame = true
+	r.overflow = false
+	var length [ringFrameHeaderSize]byte
+	r.Write(length[:])
+}
+
+// EndFrame completes the frame, the frame is available for WriteTo()
+func (r *Ring) EndFrame() {
+	if !r.inFrame {
+		return
+	}
+	r.inFrame = false
+	if r.overflow {
+		r.tail = r.frameStart
+		r.statistics.Dropped++
+		return
+	}
+	var length [ringFrameHeaderSize]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(r.tail-r.frameStart-ringFrameHeaderSize))
+	r.copyTo(r.frameStart, length[:])
+	r.frameStart = r.tail
+	r.statistics.Frames++
+}
+
+// Write adds the data to the current frame, drops the oldest frames if
+// there is no room
+func (r *Ring) Write(data []byte) (int, error) {
+	size := uint64(len(r.data))
+	if !r.inFrame || r.overflow {
+		return len(data), nil
+	}
+	if r.tail-r.frameStart+uint64(len(data)) > size {
+		r.overflow = true
+		return len(data), nil
+	}
+	for size-(r.tail-r.head) < uint64(len(data)) {
+		r.evict()
+	}
+	r.copyTo(r.tail, data)
+	r.tail += uint64(len(data))
+	return len(data), nil
+}
+
+// WriteTo writes the complete frames, the oldest frame first, without the
+// length prefixes. The frames remain in the ring
+func (r *Ring) WriteTo(w stdio.Writer) (int64, error) {
+	return r.WriteFrom(w, r.head)
+}
+
+// WriteFrom writes the complete frames starting at the position, see Head()
+// and Position(). The position is a frame boundary
+func (r *Ring) WriteFrom(w stdio.Writer, position uint64) (int64, error) {
+	var total int64
+	var length [ringFrameHeaderSize]byte
+	if position < r.head {
+		position = r.head
+	}
+	for position < r.frameStart {
+		r.copyFrom(position, length[:])
+		frameSize := uint64(binary.LittleEndian.Uint32(length[:]))
+		position += ringFrameHeaderSize
+		for _, part := range r.parts(position, frameSize) {
+			n, err := w.Write(part)
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+		}
+		position += frameSize
+	}
+	return total, nil
+}
+
+// Len returns number of bytes in the complete frames, including the
+// length prefixes
+func (r *Ring) Len() int {
+	return int(r.frameStart - r.head)
+}
+
+// Head returns the position of the oldest frame
+func (r *Ring) Head() uint64 {
+	return r.head
+}
+
+// Position returns the position of the next frame
+func (r *Ring) Position() uint64 {
+	return r.frameStart
+}
+
+func (r *Ring) GetStatistics() RingStatistics {
+	return r.statistics
+}
+
+// Drop the oldest complete frame
+func (r *Ring) evict() {
+	var length [ringFrameHeaderSize]byte
+	r.copyFrom(r.head, length[:])
+	r.head += ringFrameHeaderSize + uint64(binary.LittleEndian.Uint32(length[:]))
+	r.statistics.Evicted++
+}
+
+// Returns one or two slices of the ring: the data can wrap around
+func (r *Ring) parts(position uint64, count uint64) [][]byte {
+	size := uint64(len(r.data))
+	offset := position % size
+	if offset+count <= size {
+		return [][]byte{r.data[offset : offset+count]}
+	}
+	return [][]byte{r.data[offset:], r.data[:offset+count-size]}
+}
+
+func (r *Ring) copyTo(position uint64, data []byte) {
+	for _, part := range r.parts(position, uint64(len(data))) {
+		n := copy(part, data)
+		data = data[n:]
+	}
+}
+
+func (r *Ring) copyFrom(position uint64, data []byte) {
+	for _, part := range r.parts(position, uint64(len(data))) {
+		n := copy(data, part)
+		data = data[n:]
+	}
+}
@@ -0,0 +1,61 @@
+package io
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	ring := NewRing(64)
+	for i := 0; i < 100; i++ {
+		ring.StartFrame()
+		ring.Write([]byte(fmt.Sprintf("%03d", i)))
+		ring.Write([]byte("|"))
+		ring.EndFrame()
+	}
+	var buf bytes.Buffer
+	ring.WriteTo(&buf)
+	// 8 bytes per frame, 64 bytes ring
+	if expected := "092|093|094|095|096|097|098|099|"; buf.String() != expected {
+		t.Fatalf("Ring contains '%s' instead of '%s'", buf.String(), expected)
+	}
+	if statistics := ring.GetStatistics(); statistics.Frames != 100 || statistics.Evicted != 92 {
+		t.Fatalf("Unexpected statistics %v", statistics)
+	}
+	// The frames from the position of the last two frames
+	buf.Reset()
+	ring.WriteFrom(&buf, ring.Position()-16)
+	if expected := "098|099|"; buf.String() != expected {
+		t.Fatalf("Ring contains '%s' instead of '%s'", buf.String(), expected)
+	}
+	// The position before the oldest frame
+	buf.Reset()
+	ring.WriteFrom(&buf, ring.Head()-8)
+	if expected := "092|093|094|095|096|097|098|099|"; buf.String() != expected {
+		t.Fatalf("Ring contains '%s' instead of '%s'", buf.String(), expected)
+	}
+}
+
+func TestRingDropFrame(t *testing.T) {
+	ring := NewRing(32)
+	ring.StartFrame()
+	ring.Write([]byte("Hello"))
+	ring.EndFrame()
+	// The frame does not fit the ring
+	ring.StartFrame()
+	ring.Write(make([]byte, 40))
+	ring.EndFrame()
+	// Incomplete frame
+	ring.StartFrame()
+	ring.Write([]byte("world"))
+
+	var buf bytes.Buffer
+	ring.WriteTo(&buf)
+	if buf.String() != "Hello" {
+		t.Fatalf("Ring contains '%s' instead of 'Hello'", buf.String())
+	}
+	if statistics := ring.GetStatistics(); statistics.Frames != 1 || statistics.Dropped != 1 {
+		t.Fatalf("Unexpected statistics %v", statistics)
+	}
+}
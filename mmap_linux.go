@@ -0,0 +1,279 @@
+//go:build linux
+// +build linux
+
+package binlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// MmapFile is a log file mapped to the memory. The data survives a crash of
+// the process, including kill -9, without a flush: the data is in the page
+// cache of the kernel as soon as Log() returns
+//
+// The file starts with a small header: magic, flags and the committed
+// offset. FrameEnd() updates the committed offset, everything before the
+// committed offset is complete frames. The file grows in chunks
+// MmapFile is both the IOWriter and the WriterControl of the logger:
+//
+//	file, err := NewMmapFile(MmapFileConfig{Filename: "app.binlog"})
+//	binlog := New(Config{IOWriter: file, WriterControl: file, ...})
+//	file.SetDictionary(binlog)
+//
+// Use RecoverMmapFile() to read the binary stream after a crash
+// Set ADD_FRAME_HEADER and ADD_FRAME_CRC to recover the frames the logger
+// completed after the last update of the committed offset. Without the CRC
+// I can not tell a complete frame from zeros or a partial frame
+type MmapFile struct {
+	config   MmapFileConfig
+	mutex    sync.Mutex
+	file     *os.File
+	data     []byte // the mapped file
+	position int64  // offset of the next byte
+
+	// A copy of the committed offset in the header. Committed() can not
+	// read the mapped memory without the lock: grow() remaps the file
+	committedOffset int64
+}
+
+type MmapFileConfig struct {
+	Filename  string
+	ChunkSize int64 // the file grows by ChunkSize bytes, 1MB by default
+}
+
+const MMAP_MAGIC = "binlogmm"
+
+// Layout of the header: magic, flags, reserved, committed offset (aligned)
+const (
+	mmapFlagsOffset     = 8
+	mmapCommittedOffset = 16
+	MMAP_HEADER_SIZE    = 64
+)
+
+// NewMmapFile creates the file or continues after the last complete frame
+// in an existing file
+func NewMmapFile(config MmapFileConfig) (*MmapFile, error) {
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = 1 << 20
+	}
+	file, err := os.OpenFile(config.Filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m := &MmapFile{config: config, file: file}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if fileInfo.Size() == 0 {
+		err = m.create()
+	} else {
+		err = m.recover(fileInfo.Size())
+	}
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *MmapFile) create() error {
+	if err := m.grow(MMAP_HEADER_SIZE); err != nil {
+		return err
+	}
+	copy(m.data, MMAP_MAGIC)
+	binary.LittleEndian.PutUint32(m.data[mmapFlagsOffset:], mmapFlags())
+	m.position = MMAP_HEADER_SIZE
+	m.commit()
+	return nil
+}
+
+// Continue after the last complete frame, clear the partial frame
+func (m *MmapFile) recover(size int64) error {
+	if err := m.mmap(size); err != nil {
+		return err
+	}
+	end, err := findMmapEnd(m.data)
+	if err != nil {
+		return err
+	}
+	if flags := binary.LittleEndian.Uint32(m.data[mmapFlagsOffset:]); flags != mmapFlags() {
+		return fmt.Errorf("Flags %x of %s do not match %x", flags, m.config.Filename, mmapFlags())
+	}
+	m.position = end
+	for i := range m.data[end:] {
+		m.data[end+int64(i)] = 0
+	}
+	m.commit()
+	return nil
+}
+
+// I keep the flags which affect the recovery
+func mmapFlags() uint32 {
+	options := DecoderOptions{AddFrameHeader: ADD_FRAME_HEADER, AddFrameCRC: ADD_FRAME_CRC}
+	return options.flags()
+}
+
+// SetDictionary writes the dictionary after the last recovered frame. The file
+// can contain the frames of another logger, for example, of the process before
+// a restart
+func (m *MmapFile) SetDictionary(dictionary DictionaryWriter) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	err := dictionary.WriteDictionary(m)
+	m.commit()
+	return err
+}
+
+func (m *MmapFile) FrameStart(io.Writer) {
+	m.mutex.Lock()
+}
+
+func (m *MmapFile) TryFrameStart(ioWriter io.Writer, timeout time.Duration) bool {
+	return tryLock(&m.mutex, timeout)
+}
+
+// The frame is complete, I can move the committed offset
+func (m *MmapFile) FrameEnd(io.Writer) {
+	m.commit()
+	m.mutex.Unlock()
+}
+
+// Write is called between FrameStart() and FrameEnd()
+func (m *MmapFile) Write(data []byte) (int, error) {
+	end := m.position + int64(len(data))
+	if end > int64(len(m.data)) {
+		if err := m.grow(end); err != nil {
+			return 0, err
+		}
+	}
+	copy(m.data[m.position:], data)
+	m.position = end
+	return len(data), nil
+}
+
+// Committed returns the offset of the end of the last complete frame
+func (m *MmapFile) Committed() int64 {
+	return atomic.LoadInt64(&m.committedOffset)
+}
+
+// Sync flushes the mapped memory to the disk. The application does not need
+// Sync() to survive a crash of the process, only a crash of the system
+func (m *MmapFile) Sync() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&m.data[0])), uintptr(len(m.data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (m *MmapFile) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var err error
+	if m.data != nil {
+		err = syscall.Munmap(m.data)
+		m.data = nil
+	}
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// The committed offset is aligned, the store is atomic
+func (m *MmapFile) committed() *uint64 {
+	return (*uint64)(unsafe.Pointer(&m.data[mmapCommittedOffset]))
+}
+
+func (m *MmapFile) commit() {
+	atomic.StoreUint64(m.committed(), uint64(m.position))
+	atomic.StoreInt64(&m.committedOffset, m.position)
+}
+
+// Grow the file to fit the size rounded up to the chunk
+func (m *MmapFile) grow(size int64) error {
+	size = (size + m.config.ChunkSize - 1) / m.config.ChunkSize * m.config.ChunkSize
+	if err := m.file.Truncate(size); err != nil {
+		return err
+	}
+	return m.mmap(size)
+}
+
+func (m *MmapFile) mmap(size int64) error {
+	if m.data != nil {
+		if err := syscall.Munmap(m.data); err != nil {
+			return err
+		}
+		m.data = nil
+	}
+	data, err := syscall.Mmap(int(m.file.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	m.data = data
+	return nil
+}
+
+// RecoverMmapFile returns the binary stream from the file written by
+// MmapFile: everything before the committed offset and the complete frames
+// after the committed offset
+func RecoverMmapFile(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	end, err := findMmapEnd(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[MMAP_HEADER_SIZE:end], nil
+}
+
+// Returns the end of the last complete frame
+// If ADD_FRAME_HEADER and ADD_FRAME_CRC were set I check the frames after the
+// committed offset: the logger could complete the frames and crash before
+// FrameEnd()
+func findMmapEnd(data []byte) (int64, error) {
+	if len(data) < MMAP_HEADER_SIZE || string(data[:len(MMAP_MAGIC)]) != MMAP_MAGIC {
+		return 0, fmt.Errorf("Bad header of the memory mapped file")
+	}
+	var options DecoderOptions
+	options.setFlags(binary.LittleEndian.Uint32(data[mmapFlagsOffset:]))
+	end := int64(binary.LittleEndian.Uint64(data[mmapCommittedOffset:]))
+	if end < MMAP_HEADER_SIZE || end > int64(len(data)) {
+		return 0, fmt.Errorf("Bad committed offset %d", end)
+	}
+	if !options.AddFrameHeader || !options.AddFrameCRC {
+		return end, nil
+	}
+	const crcSize = 4
+	for {
+		frame := data[end:]
+		if len(frame) < FRAME_HEADER_SIZE || binary.LittleEndian.Uint16(frame) != FRAME_SYNC {
+			return end, nil
+		}
+		size := int64(binary.LittleEndian.Uint32(frame[2:]))
+		if size > MAX_FRAME_SIZE || FRAME_HEADER_SIZE+size+crcSize > int64(len(frame)) {
+			return end, nil
+		}
+		payload := frame[FRAME_HEADER_SIZE : FRAME_HEADER_SIZE+size]
+		crc := binary.LittleEndian.Uint32(frame[FRAME_HEADER_SIZE+size:])
+		if crc != crc32.Checksum(payload, crc32cTable) {
+			return end, nil
+		}
+		end += FRAME_HEADER_SIZE + size + crcSize
+	}
+}
@@ -0,0 +1,182 @@
+//go:build linux
+// +build linux
+
+package binlog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func decodeMmapFile(t *testing.T, filename string) []string {
+	data, err := RecoverMmapFile(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	decoder := NewDecoder(bytes.NewReader(data), nil, &DecoderOptions{})
+	logs := []string{}
+	for decoder.Next() {
+		logs = append(logs, Format(decoder.Entry()))
+	}
+	if err := decoder.Err(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return logs
+}
+
+func TestMmapFile(t *testing.T) {
+	ADD_DICTIONARY, ADD_FRAME_HEADER, ADD_FRAME_CRC = true, true, true
+	defer func() { ADD_DICTIONARY, ADD_FRAME_HEADER, ADD_FRAME_CRC = false, false, false }()
+	filename := filepath.Join(t.TempDir(), "binlog")
+	file, err := NewMmapFile(MmapFileConfig{Filename: filename, ChunkSize: 4096})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: file, WriterControl: file, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	file.SetDictionary(binlog)
+
+	// The file grows a few times
+	for i := 0; i < 1000; i++ {
+		binlog.Log("Hello %d", i)
+	}
+	// The logger wrote the frame and did not call FrameEnd()
+	var buf bytes.Buffer
+	frameLogger := New(Config{IOWriter: &buf, WriterControl: &WriterControlDummy{}, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	frameLogger.Log("Hello %d", 1000)
+	frame := buf.Bytes()[bytes.LastIndex(buf.Bytes(), []byte{0x0C, 0xB1}):]
+	file.FrameStart(file)
+	file.Write(frame)
+	committed := file.Committed()
+	// The logger wrote a part of the frame
+	file.Write(frame[:len(frame)-1])
+
+	logs := decodeMmapFile(t, filename)
+	if len(logs) != 1001 || logs[1000] != "Hello 1000" {
+		t.Fatalf("Recovered %d logs instead of 1001", len(logs))
+	}
+	// Skip FrameEnd(), the partial frame is not committed
+	file.mutex.Unlock()
+	file.Close()
+
+	// Reopen the file, the partial frame is lost
+	file, err = NewMmapFile(MmapFileConfig{Filename: filename, ChunkSize: 4096})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if file.Committed() != committed+int64(len(frame)) {
+		t.Fatalf("Committed offset %d instead of %d", file.Committed(), committed+int64(len(frame)))
+	}
+	binlog = New(Config{IOWriter: file, WriterControl: file, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	binlog.Log("Hello %s", "again")
+	file.Close()
+	logs = decodeMmapFile(t, filename)
+	if len(logs) != 1002 || logs[1001] != "Hello again" {
+		t.Fatalf("Recovered %d logs instead of 1002", len(logs))
+	}
+}
+
+// The restarted process appends to the file, the file contains the
+// dictionaries of both processes
+func TestMmapFileReopen(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "binlog")
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	for i := 0; i < 2; i++ {
+		// The process logged before the process opened the file
+		binlog := New(Config{IOWriter: io.Discard, WriterControl: &WriterControlDummy{}, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+		// The processes use different format strings
+		format := fmt.Sprintf("Process %d %%s", i)
+		binlog.Log(format, "started")
+		file, err := NewMmapFile(MmapFileConfig{Filename: filename, ChunkSize: 4096})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		binlog.config.IOWriter, binlog.config.WriterControl = file, file
+		if err := file.SetDictionary(binlog); err != nil {
+			t.Fatalf("%v", err)
+		}
+		binlog.Log(format, "started")
+		file.Close()
+	}
+	if logs := decodeMmapFile(t, filename); len(logs) != 2 || logs[1] != "Process 1 started" {
+		t.Fatalf("Unexpected logs %v in %s", logs, filename)
+	}
+}
+
+// The child process logs and kills itself
+func TestMmapFileKill(t *testing.T) {
+	if filename := os.Getenv("BINLOG_MMAP_FILE"); filename != "" {
+		file, err := NewMmapFile(MmapFileConfig{Filename: filename})
+		if err != nil {
+			os.Exit(1)
+		}
+		constDataBase, constDataSize := GetSelfTextAddressSize()
+		binlog := New(Config{IOWriter: file, WriterControl: file, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+		for i := 0; i < 100; i++ {
+			binlog.Log("Hello %d", i)
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGKILL)
+	}
+	filename := filepath.Join(t.TempDir(), "binlog")
+	cmd := exec.Command(os.Args[0], "-test.run=TestMmapFileKill")
+	cmd.Env = append(os.Environ(), "BINLOG_MMAP_FILE="+filename)
+	cmd.Run()
+	if state := cmd.ProcessState; state == nil || state.Sys().(syscall.WaitStatus).Signal() != syscall.SIGKILL {
+		t.Fatalf("Child process was not killed: %v", state)
+	}
+	data, err := RecoverMmapFile(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	var buf bytes.Buffer
+	binlog := New(Config{IOWriter: &buf, WriterControl: &WriterControlDummy{}, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	binlog.Log("Hello %d", 0)
+	decoder := NewDecoder(bytes.NewReader(data), binlog.GetDictionary(), nil)
+	count := 0
+	for decoder.Next() {
+		if actual := Format(decoder.Entry()); actual != fmt.Sprintf("Hello %d", count) {
+			t.Fatalf("Print failed expected 'Hello %d', actual '%s'", count, actual)
+		}
+		count++
+	}
+	if decoder.Err() != nil || count != 100 {
+		t.Fatalf("Recovered %d logs instead of 100: %v", count, decoder.Err())
+	}
+}
+
+// Without the CRC the recovery stops at the committed offset
+func TestMmapFileNoCRC(t *testing.T) {
+	ADD_FRAME_HEADER = true
+	defer func() { ADD_FRAME_HEADER = false }()
+	filename := filepath.Join(t.TempDir(), "binlog")
+	file, err := NewMmapFile(MmapFileConfig{Filename: filename, ChunkSize: 4096})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: file, WriterControl: file, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	binlog.Log("Hello %d", 1)
+	committed := file.Committed()
+	// A frame header followed by zeros
+	file.FrameStart(file)
+	file.Write([]byte{0x0C, 0xB1, 8, 0, 0, 0})
+	file.mutex.Unlock()
+	file.Close()
+	if file.Committed() != committed {
+		t.Fatalf("Committed offset %d instead of %d", file.Committed(), committed)
+	}
+	data, err := RecoverMmapFile(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if int64(len(data)) != committed-MMAP_HEADER_SIZE {
+		t.Fatalf("Recovered %d bytes instead of %d", len(data), committed-MMAP_HEADER_SIZE)
+	}
+}
@@ -0,0 +1,345 @@
+package binlog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// VersionedDictionary is a DictionaryWriter which reports changes of the
+// dictionary, for example, *Binlog
+type VersionedDictionary interface {
+	DictionaryWriter
+	DictionaryVersion() uint64
+}
+
+type NetworkSinkConfig struct {
+	Network           string        // "tcp" or "unix"
+	Address           string        // for example, "collector:7070" or "/var/run/binlog.sock"
+	BatchSize         int           // send the batch when the batch is larger than BatchSize bytes, 64KB by default
+	FlushInterval     time.Duration // send the batch at least every FlushInterval, 100ms by default
+	MaxBacklog        int           // drop the new frames if MaxBacklog bytes are waiting, 4MB by default
+	ReconnectInterval time.Duration // wait between the connection attempts, 1s by default
+	WriteTimeout      time.Duration // 5s by default
+}
+
+// NetworkSink sends the frames to a collector over TCP or a Unix domain
+// socket. The logger does not wait for the network: the frames are
+// collected in a batch and a goroutine sends the batch
+// When the connection is lost the goroutine reconnects and sends the batch
+// again. While there is no connection the frames wait in the backlog. If the
+// backlog is full the sink drops the new frames
+// Every connection starts with the stream header and the dictionary, the
+// collector decodes every connection separately. The sink writes the
+// dictionary when the sink connects, after the sink dropped frames and, if
+// ADD_DICTIONARY is not set, before a batch with new format strings
+// With INTERN_TABLE_SIZE the backlog refers to the strings defined on the
+// lost connection. The sink drops the backlog when the connection fails,
+// the logger starts a new intern table
+// NetworkSink is both the IOWriter and the WriterControl of the logger:
+//
+//	sink := NewNetworkSink(NetworkSinkConfig{Network: "tcp", Address: "collector:7070"})
+//	binlog := New(Config{IOWriter: sink, WriterControl: sink, ...})
+//	sink.SetDictionary(binlog)
+type NetworkSink struct {
+	config NetworkSinkConfig
+	mutex  sync.Mutex
+
+	pending    []byte // frames the logger added since the last batch
+	sending    []byte // the batch, kept until the collector gets the batch
+	frameStart int    // offset of the current frame in pending
+
+	// The goroutine sending the batches calls WriteDictionary() under the
+	// lock, the logger changes the dictionary between FrameStart() and
+	// FrameEnd()
+	dictionary        DictionaryWriter
+	dictionaryVersion uint64 // the version of the last dictionary sent
+	resendDictionary  bool   // the sink dropped frames with the dictionary records
+
+	statistics NetworkSinkStatistics
+	wake       chan struct{}
+	done       chan struct{}
+	stopped    sync.WaitGroup
+	closeOnce  sync.Once
+	closeErr   error // the backlog the goroutine failed to send, see flush()
+}
+
+type NetworkSinkStatistics struct {
+	Connects  uint64
+	Errors    uint64 // failed connection attempts and writes
+	Dropped   uint64 // frames dropped because the backlog is full
+	Discarded uint64 // bytes of the backlog dropped with the lost connection, see INTERN_TABLE_SIZE
+	Sent      uint64 // bytes sent, including the dictionaries
+}
+
+// NewNetworkSink starts the goroutine sending the frames
+// The goroutine connects when the first batch is ready
+func NewNetworkSink(config NetworkSinkConfig) *NetworkSink {
+	if config.BatchSize <= 0 {
+		config.BatchSize = 64 << 10
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 100 * time.Millisecond
+	}
+	if config.MaxBacklog <= 0 {
+		config.MaxBacklog = 4 << 20
+	}
+	if config.ReconnectInterval <= 0 {
+		config.ReconnectInterval = time.Second
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = 5 * time.Second
+	}
+	s := &NetworkSink{
+		config: config,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	s.stopped.Add(1)
+	go s.run()
+	return s
+}
+
+// SetDictionary sets the source of the dictionary for the connections
+func (s *NetworkSink) SetDictionary(dictionary DictionaryWriter) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dictionary = dictionary
+	s.resendDictionary = true
+	return nil
+}
+
+// Append the dictionary to the data, called under the lock
+func (s *NetworkSink) appendDictionary(data []byte) []byte {
+	s.resendDictionary = false
+	if s.dictionary == nil {
+		return data
+	}
+	buf := bytes.NewBuffer(data)
+	if err := s.dictionary.WriteDictionary(buf); err != nil {
+		s.statistics.Errors++
+	}
+	if versioned, ok := s.dictionary.(VersionedDictionary); ok {
+		s.dictionaryVersion = versioned.DictionaryVersion()
+	}
+	return buf.Bytes()
+}
+
+// Without ADD_DICTIONARY the collector needs the dictionary before the
+// new format strings
+func (s *NetworkSink) dictionaryRequired() bool {
+	if s.resendDictionary {
+		return true
+	}
+	versioned, ok := s.dictionary.(VersionedDictionary)
+	return ok && !ADD_DICTIONARY && versioned.DictionaryVersion() != s.dictionaryVersion
+}
+
+func (s *NetworkSink) FrameStart(io.Writer) {
+	s.mutex.Lock()
+	s.frameStart = len(s.pending)
+}
+
+func (s *NetworkSink) TryFrameStart(ioWriter io.Writer, timeout time.Duration) bool {
+	if !tryLock(&s.mutex, timeout) {
+		return false
+	}
+	s.frameStart = len(s.pending)
+	return true
+}
+
+// If the backlog is full I drop the frame. The frame could contain the
+// dictionary records (ADD_DICTIONARY), the next batch starts with the
+// dictionary. The frame could contain the define records, the logger starts
+// a new intern table
+func (s *NetworkSink) FrameEnd(io.Writer) {
+	if len(s.sending)+len(s.pending) > s.config.MaxBacklog {
+		s.pending = s.pending[:s.frameStart]
+		s.statistics.Dropped++
+		s.resendDictionary = true
+		if resetter, ok := s.dictionary.(InternTableResetter); ok {
+			resetter.ResetInternTable()
+		}
+	}
+	batchReady := len(s.pending) >= s.config.BatchSize
+	s.mutex.Unlock()
+	if batchReady {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Write is called between FrameStart() and FrameEnd()
+func (s *NetworkSink) Write(data []byte) (int, error) {
+	s.pending = append(s.pending, data...)
+	return len(data), nil
+}
+
+func (s *NetworkSink) GetStatistics() NetworkSinkStatistics {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.statistics
+}
+
+// Close sends the backlog and stops the goroutine. The goroutine reconnects
+// until WriteTimeout expires. Close returns an error if the sink dropped
+// a part of the backlog
+func (s *NetworkSink) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.stopped.Wait()
+	return s.closeErr
+}
+
+func (s *NetworkSink) run() {
+	defer s.stopped.Done()
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+	var conn net.Conn
+	var lastDial time.Time
+	for {
+		closing := false
+		select {
+		case <-s.wake:
+		case <-ticker.C:
+		case <-s.done:
+			closing = true
+		}
+		if conn == nil && time.Since(lastDial) >= s.config.ReconnectInterval {
+			lastDial = time.Now()
+			conn = s.connect()
+		}
+		if conn != nil && !s.send(conn) {
+			s.disconnect(conn)
+			conn = nil
+		}
+		if closing {
+			s.closeErr = s.flush(conn, lastDial)
+			return
+		}
+	}
+}
+
+// Send the backlog before the goroutine exits, reconnect if needed
+func (s *NetworkSink) flush(conn net.Conn, lastDial time.Time) error {
+	deadline := time.Now().Add(s.config.WriteTimeout)
+	discarded := 0
+	for {
+		s.mutex.Lock()
+		backlog := len(s.sending) + len(s.pending)
+		s.mutex.Unlock()
+		if backlog == 0 || !time.Now().Before(deadline) {
+			if conn != nil {
+				conn.Close()
+			}
+			if backlog+discarded != 0 {
+				return fmt.Errorf("Failed to send %d bytes to %s", backlog+discarded, s.config.Address)
+			}
+			return nil
+		}
+		if conn == nil {
+			if wait := time.Until(lastDial.Add(s.config.ReconnectInterval)); wait > 0 {
+				if wait > time.Until(deadline) {
+					wait = time.Until(deadline)
+				}
+				time.Sleep(wait)
+				continue
+			}
+			lastDial = time.Now()
+			conn = s.connect()
+			continue
+		}
+		if !s.send(conn) {
+			discarded += s.disconnect(conn)
+			conn = nil
+		}
+	}
+}
+
+// The connection failed. The backlog could refer to the interned strings
+// defined on the connection, I drop the backlog and the next log entry
+// starts a new intern table. Returns the number of dropped bytes
+func (s *NetworkSink) disconnect(conn net.Conn) int {
+	conn.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	resetter, ok := s.dictionary.(InternTableResetter)
+	if !ok || INTERN_TABLE_SIZE == 0 {
+		return 0
+	}
+	discarded := len(s.sending) + len(s.pending)
+	s.statistics.Discarded += uint64(discarded)
+	s.sending, s.pending = s.sending[:0], s.pending[:0]
+	s.resendDictionary = true
+	resetter.ResetInternTable()
+	return discarded
+}
+
+// Dial and send the dictionary
+func (s *NetworkSink) connect() net.Conn {
+	conn, err := net.DialTimeout(s.config.Network, s.config.Address, s.config.WriteTimeout)
+	if err != nil {
+		s.addStatistics(0, 1, 0)
+		return nil
+	}
+	s.mutex.Lock()
+	snapshot := s.appendDictionary(nil)
+	s.mutex.Unlock()
+	if !s.write(conn, snapshot) {
+		conn.Close()
+		return nil
+	}
+	s.addStatistics(1, 0, 0)
+	return conn
+}
+
+// Send the batch, returns false if the connection failed
+// The batch remains in the backlog until the write succeeds
+func (s *NetworkSink) send(conn net.Conn) bool {
+	s.mutex.Lock()
+	if len(s.sending) == 0 && len(s.pending) != 0 {
+		if s.dictionaryRequired() {
+			s.sending = append(s.appendDictionary(s.sending[:0]), s.pending...)
+			s.pending = s.pending[:0]
+		} else {
+			s.sending, s.pending = s.pending, s.sending[:0]
+		}
+	}
+	batch := s.sending
+	s.mutex.Unlock()
+	if len(batch) == 0 {
+		return true
+	}
+	if !s.write(conn, batch) {
+		return false
+	}
+	s.mutex.Lock()
+	s.sending = s.sending[:0]
+	s.mutex.Unlock()
+	return true
+}
+
+func (s *NetworkSink) write(conn net.Conn, data []byte) bool {
+	conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+	n, err := conn.Write(data)
+	if err != nil {
+		s.addStatistics(0, 1, n)
+		return false
+	}
+	s.addStatistics(0, 0, n)
+	return true
+}
+
+func (s *NetworkSink) addStatistics(connects uint64, errors uint64, sent int) {
+	s.mutex.Lock()
+	s.statistics.Connects += connects
+	s.statistics.Errors += errors
+	s.statistics.Sent += uint64(sent)
+	s.mutex.Unlock()
+}
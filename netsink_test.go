@@ -0,0 +1,214 @@
+package binlog
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Decode the connection until the expected log entry
+func expectNetworkLog(t *testing.T, conn net.Conn, expected string) []string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	decoder := NewDecoder(conn, nil, &DecoderOptions{})
+	logs := []string{}
+	for decoder.Next() {
+		logs = append(logs, Format(decoder.Entry()))
+		if logs[len(logs)-1] == expected {
+			return logs
+		}
+	}
+	t.Fatalf("Missing '%s', got %d logs, %v", expected, len(logs), decoder.Err())
+	return nil
+}
+
+func TestNetworkSink(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer listener.Close()
+	sink := NewNetworkSink(NetworkSinkConfig{Network: "tcp", Address: listener.Addr().String(),
+		FlushInterval: time.Millisecond, ReconnectInterval: time.Millisecond})
+	defer sink.Close()
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: sink, WriterControl: sink, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	sink.SetDictionary(binlog)
+
+	for i := 0; i < 100; i++ {
+		binlog.Log("Hello %d", i)
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	logs := expectNetworkLog(t, conn, "Hello 99")
+	for i, log := range logs {
+		if expected := fmt.Sprintf("Hello %d", i); log != expected {
+			t.Fatalf("Print failed expected '%s', actual '%s'", expected, log)
+		}
+	}
+	conn.Close()
+
+	// The sink reconnects and sends the dictionary again, the new
+	// format string appears after the reconnect
+	tcpListener := listener.(*net.TCPListener)
+	for i := 0; ; i++ {
+		binlog.Log("Hello %d", i)
+		tcpListener.SetDeadline(time.Now().Add(time.Millisecond))
+		if conn, err = listener.Accept(); err == nil {
+			break
+		}
+		if i > 5000 {
+			t.Fatalf("The sink did not reconnect")
+		}
+	}
+	defer conn.Close()
+	binlog.Log("Reconnected %s", "world")
+	expectNetworkLog(t, conn, "Reconnected world")
+	if statistics := sink.GetStatistics(); statistics.Connects < 2 {
+		t.Fatalf("Unexpected statistics %v", statistics)
+	}
+}
+
+func TestNetworkSinkUnix(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "binlog.sock")
+	listener, err := net.Listen("unix", address)
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	defer listener.Close()
+	sink := NewNetworkSink(NetworkSinkConfig{Network: "unix", Address: address, FlushInterval: time.Millisecond})
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: sink, WriterControl: sink, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	sink.SetDictionary(binlog)
+	binlog.Log("Hello %s", "unix")
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	expectNetworkLog(t, conn, "Hello unix")
+	// Close sends the backlog
+	binlog.Log("Goodbye %s", "unix")
+	if err := sink.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expectNetworkLog(t, conn, "Goodbye unix")
+}
+
+// No collector: the backlog is full and the sink drops the frames
+func TestNetworkSinkBacklog(t *testing.T) {
+	sink := NewNetworkSink(NetworkSinkConfig{Network: "unix", Address: filepath.Join(t.TempDir(), "missing.sock"),
+		FlushInterval: time.Millisecond, MaxBacklog: 1024, WriteTimeout: 10 * time.Millisecond})
+	defer sink.Close()
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: sink, WriterControl: sink, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	sink.SetDictionary(binlog)
+	for i := 0; i < 1000; i++ {
+		binlog.Log("Hello %d", i)
+	}
+	if statistics := sink.GetStatistics(); statistics.Dropped == 0 || statistics.Connects != 0 {
+		t.Fatalf("Unexpected statistics %v", statistics)
+	}
+}
+
+// No collector: Close gives up after WriteTimeout and reports the backlog
+func TestNetworkSinkCloseTimeout(t *testing.T) {
+	sink := NewNetworkSink(NetworkSinkConfig{Network: "unix", Address: filepath.Join(t.TempDir(), "missing.sock"),
+		ReconnectInterval: time.Millisecond, WriteTimeout: 50 * time.Millisecond})
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: sink, WriterControl: sink, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	sink.SetDictionary(binlog)
+	binlog.Log("Hello %s", "world")
+	if err := sink.Close(); err == nil {
+		t.Fatalf("Close did not report the backlog")
+	}
+	if statistics := sink.GetStatistics(); statistics.Errors < 2 {
+		t.Fatalf("Unexpected statistics %v", statistics)
+	}
+}
+
+// The dropped frame contains the dictionary record, the sink sends the
+// dictionary before the next batch
+func TestNetworkSinkDropDictionary(t *testing.T) {
+	ADD_DICTIONARY = true
+	defer func() { ADD_DICTIONARY = false }()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer listener.Close()
+	sink := NewNetworkSink(NetworkSinkConfig{Network: "tcp", Address: listener.Addr().String(),
+		FlushInterval: time.Millisecond, MaxBacklog: 512})
+	defer sink.Close()
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: sink, WriterControl: sink, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	sink.SetDictionary(binlog)
+	binlog.Log("Hello %d", 1)
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	decoder := NewDecoder(conn, nil, &DecoderOptions{})
+	if !decoder.Next() || Format(decoder.Entry()) != "Hello 1" {
+		t.Fatalf("Failed to decode %v", decoder.Err())
+	}
+	// The frame is larger than the backlog
+	binlog.Log("Big %s", strings.Repeat("x", 1024))
+	binlog.Log("Big %s", "small")
+	if !decoder.Next() || Format(decoder.Entry()) != "Big small" {
+		t.Fatalf("Failed to decode %v", decoder.Err())
+	}
+	if statistics := sink.GetStatistics(); statistics.Dropped != 1 {
+		t.Fatalf("Unexpected statistics %v", statistics)
+	}
+}
+
+// The backlog refers to the strings defined on the lost connection, the sink
+// drops the backlog and the logger defines the strings again
+func TestNetworkSinkInternTable(t *testing.T) {
+	INTERN_TABLE_SIZE = 4
+	defer func() { INTERN_TABLE_SIZE = 0 }()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer listener.Close()
+	sink := NewNetworkSink(NetworkSinkConfig{Network: "tcp", Address: listener.Addr().String(),
+		FlushInterval: time.Millisecond, ReconnectInterval: time.Millisecond})
+	defer sink.Close()
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: sink, WriterControl: sink, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	sink.SetDictionary(binlog)
+	path := fmt.Sprintf("/api/%s", "users")
+	binlog.Log("GET %s", path)
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expectNetworkLog(t, conn, "GET /api/users")
+	conn.Close()
+
+	tcpListener := listener.(*net.TCPListener)
+	for i := 0; ; i++ {
+		binlog.Log("GET %s", path)
+		tcpListener.SetDeadline(time.Now().Add(time.Millisecond))
+		if conn, err = listener.Accept(); err == nil {
+			break
+		}
+		if i > 5000 {
+			t.Fatalf("The sink did not reconnect")
+		}
+	}
+	defer conn.Close()
+	binlog.Log("Reconnected %s", path)
+	expectNetworkLog(t, conn, "Reconnected /api/users")
+	if statistics := binlog.GetStatistics(); statistics.InternHit == 0 {
+		t.Fatalf("Unexpected statistics %+v", statistics)
+	}
+}
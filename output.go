@@ -0,0 +1,154 @@
+package binlog
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// EntryEncoder writes decoded log entries to a text stream, one log entry
+// per line
+type EntryEncoder interface {
+	Encode(*LogEntry) error
+}
+
+// TextEncoder writes log entries exactly as fmt.Sprintf() would print them
+type TextEncoder struct {
+	ioWriter io.Writer
+}
+
+func NewTextEncoder(ioWriter io.Writer) *TextEncoder {
+	return &TextEncoder{ioWriter: ioWriter}
+}
+
+func (e *TextEncoder) Encode(logEntry *LogEntry) error {
+	_, err := io.WriteString(e.ioWriter, Format(logEntry)+"\n")
+	return err
+}
+
+// JSONEncoder writes log entries as JSON Lines
+//
+//	{"ts":1257894000000000000,"file":"main.go","line":12,"msg":"Hello world 1","args":["world",1]}
+//
+// The arguments keep the types of the arguments of Log(), for example,
+// uint64 is a JSON number and not a string. The file, the line and the index
+// are omitted if the binary stream does not carry them
+type JSONEncoder struct {
+	encoder *json.Encoder
+}
+
+type jsonLogEntry struct {
+	Timestamp  int64         `json:"ts"`
+	Filename   string        `json:"file,omitempty"`
+	LineNumber int           `json:"line,omitempty"`
+	Index      uint64        `json:"index,omitempty"`
+	Message    string        `json:"msg"`
+	Args       []interface{} `json:"args"`
+}
+
+func NewJSONEncoder(ioWriter io.Writer) *JSONEncoder {
+	encoder := json.NewEncoder(ioWriter)
+	encoder.SetEscapeHTML(false)
+	return &JSONEncoder{encoder: encoder}
+}
+
+func (e *JSONEncoder) Encode(logEntry *LogEntry) error {
+	args := logEntry.Args
+	if args == nil {
+		args = []interface{}{}
+	}
+	return e.encoder.Encode(&jsonLogEntry{
+		Timestamp:  logEntry.Timestamp,
+		Filename:   logEntry.Filename,
+		LineNumber: logEntry.LineNumber,
+		Index:      logEntry.Index,
+		Message:    Format(logEntry),
+		Args:       args,
+	})
+}
+
+// LogfmtEncoder writes log entries in logfmt format
+//
+//	ts=1257894000000000000 file=main.go line=12 msg="Hello world 1" arg0=world arg1=1
+//
+// The arguments are arg0, arg1, ... The file, the line and the index
+// are omitted if the binary stream does not carry them
+type LogfmtEncoder struct {
+	ioWriter io.Writer
+	buf      []byte
+}
+
+func NewLogfmtEncoder(ioWriter io.Writer) *LogfmtEncoder {
+	return &LogfmtEncoder{ioWriter: ioWriter}
+}
+
+func (e *LogfmtEncoder) Encode(logEntry *LogEntry) error {
+	buf := append(e.buf[:0], "ts="...)
+	buf = strconv.AppendInt(buf, logEntry.Timestamp, 10)
+	if logEntry.Filename != "" {
+		buf = append(buf, " file="...)
+		buf = appendLogfmtValue(buf, logEntry.Filename)
+		buf = append(buf, " line="...)
+		buf = strconv.AppendInt(buf, int64(logEntry.LineNumber), 10)
+	}
+	if logEntry.Index != 0 {
+		buf = append(buf, " index="...)
+		buf = strconv.AppendUint(buf, logEntry.Index, 10)
+	}
+	buf = append(buf, " msg="...)
+	buf = appendLogfmtValue(buf, Format(logEntry))
+	for i, arg := range logEntry.Args {
+		buf = append(buf, " arg"...)
+		buf = strconv.AppendInt(buf, int64(i), 10)
+		buf = append(buf, '=')
+		buf = appendLogfmtArg(buf, arg)
+	}
+	buf = append(buf, '\n')
+	e.buf = buf
+	_, err := e.ioWriter.Write(buf)
+	return err
+}
+
+// The decoder produces only integers and strings
+func appendLogfmtArg(buf []byte, arg interface{}) []byte {
+	switch arg := arg.(type) {
+	case int:
+		return strconv.AppendInt(buf, int64(arg), 10)
+	case int8:
+		return strconv.AppendInt(buf, int64(arg), 10)
+	case int16:
+		return strconv.AppendInt(buf, int64(arg), 10)
+	case int32:
+		return strconv.AppendInt(buf, int64(arg), 10)
+	case int64:
+		return strconv.AppendInt(buf, arg, 10)
+	case uint:
+		return strconv.AppendUint(buf, uint64(arg), 10)
+	case uint8:
+		return strconv.AppendUint(buf, uint64(arg), 10)
+	case uint16:
+		return strconv.AppendUint(buf, uint64(arg), 10)
+	case uint32:
+		return strconv.AppendUint(buf, uint64(arg), 10)
+	case uint64:
+		return strconv.AppendUint(buf, arg, 10)
+	case string:
+		return appendLogfmtValue(buf, arg)
+	default:
+		return appendLogfmtValue(buf, Format(&LogEntry{FmtString: "%v", Args: []interface{}{arg}}))
+	}
+}
+
+// Quote the value if the value is empty or contains spaces, quotes, '='
+// or control characters
+func appendLogfmtValue(buf []byte, value string) []byte {
+	needsQuotes := value == "" || strings.IndexFunc(value, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == '\\' || !unicode.IsPrint(r)
+	}) >= 0
+	if needsQuotes {
+		return strconv.AppendQuote(buf, value)
+	}
+	return append(buf, value...)
+}
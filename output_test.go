@@ -0,0 +1,46 @@
+package binlog
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestJSONEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := NewJSONEncoder(&buf)
+	logEntry := &LogEntry{
+		Filename:   "main.go",
+		LineNumber: 12,
+		FmtString:  "Hello %s %d %d",
+		Args:       []interface{}{"<world>", int8(-1), uint64(1 << 63)},
+		Timestamp:  1257894000000000000,
+	}
+	encoder.Encode(logEntry)
+	encoder.Encode(&LogEntry{FmtString: "Hello"})
+	expected := `{"ts":1257894000000000000,"file":"main.go","line":12,"msg":"Hello <world> -1 9223372036854775808","args":["<world>",-1,9223372036854775808]}
+{"ts":0,"msg":"Hello","args":[]}
+`
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("JSON failed expected '%s', actual '%s'", expected, actual)
+	}
+}
+
+func TestLogfmtEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := NewLogfmtEncoder(&buf)
+	logEntry := &LogEntry{
+		Filename:   "main.go",
+		LineNumber: 12,
+		FmtString:  "Hello %s %s %d",
+		Args:       []interface{}{"world", "a=\"b\"", int16(-1)},
+		Index:      3,
+	}
+	encoder.Encode(logEntry)
+	encoder.Encode(&LogEntry{FmtString: "Hello%s", Args: []interface{}{""}})
+	expected := `ts=0 file=main.go line=12 index=3 msg="Hello world a=\"b\" -1" arg0=world arg1="a=\"b\"" arg2=-1
+ts=0 msg=Hello arg0=""
+`
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("logfmt failed expected '%s', actual '%s'", expected, actual)
+	}
+}
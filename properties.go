@@ -0,0 +1,89 @@
+package binlog
+
+import (
+	"debug/elf"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Properties of the stream header the logger sets by default
+// The collector uses the properties to tell the sources apart
+const (
+	PROPERTY_PID        = "pid"
+	PROPERTY_EXECUTABLE = "executable"
+	PROPERTY_BUILD_ID   = "buildid"
+	PROPERTY_INSTANCE   = "instance" // tells apart the loggers of the same process
+)
+
+// The instance of the last logger in this process
+var lastInstance uint64
+
+var defaultProperties struct {
+	sync.Once
+	properties map[string]string
+}
+
+// Returns a copy of the properties of this process
+func getDefaultProperties() map[string]string {
+	defaultProperties.Do(func() {
+		properties := map[string]string{PROPERTY_PID: strconv.Itoa(os.Getpid())}
+		if executable, err := os.Executable(); err == nil {
+			properties[PROPERTY_EXECUTABLE] = filepath.Base(executable)
+			if buildID := getBuildID(executable); buildID != "" {
+				properties[PROPERTY_BUILD_ID] = buildID
+			}
+		}
+		defaultProperties.properties = properties
+	})
+	properties := make(map[string]string)
+	for key, value := range defaultProperties.properties {
+		properties[key] = value
+	}
+	return properties
+}
+
+// Returns the default properties and the instance of the new logger
+func getLoggerProperties() map[string]string {
+	properties := getDefaultProperties()
+	properties[PROPERTY_INSTANCE] = strconv.FormatUint(atomic.AddUint64(&lastInstance, 1), 10)
+	return properties
+}
+
+// The Go linker keeps the build ID in the ELF note .note.go.buildid
+// The note is 4 bytes name size, 4 bytes description size, 4 bytes type,
+// the name "Go\x00\x00" and the build ID
+func getBuildID(executable string) string {
+	file, err := elf.Open(executable)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	section := file.Section(".note.go.buildid")
+	if section == nil {
+		return ""
+	}
+	data, err := section.Data()
+	if err != nil || len(data) < 16 {
+		return ""
+	}
+	descriptionSize := int(file.ByteOrder.Uint32(data[4:]))
+	if 16+descriptionSize > len(data) {
+		return ""
+	}
+	return string(data[16 : 16+descriptionSize])
+}
+
+// SetProperty adds the property to the stream header, for example, the
+// name of the service. An empty value removes the property
+// SetProperty is not thread safe with Log()
+func (b *Binlog) SetProperty(key string, value string) {
+	if value == "" {
+		delete(b.properties, key)
+	} else {
+		b.properties[key] = value
+	}
+	b.dictionaryVersion++
+}
@@ -0,0 +1,324 @@
+package binlog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DictionaryWriter writes the stream header and the dictionary, for
+// example, *Binlog
+type DictionaryWriter interface {
+	WriteDictionary(io.Writer) error
+}
+
+type RotatingFileConfig struct {
+	Filename   string
+	MaxSize    int64         // rotate the file if the file is larger than MaxSize bytes, 0 - no limit
+	MaxAge     time.Duration // rotate the file if the file is older than MaxAge, 0 - no limit
+	MaxBackups int           // number of rotated files to keep, 0 - keep all
+	Compress   bool          // gzip the rotated files
+}
+
+// RotatingFile is a log file which rotates on the frame boundaries
+// RotatingFile is both the IOWriter and the WriterControl of the logger:
+//
+//	file, err := NewRotatingFile(RotatingFileConfig{Filename: "app.binlog", MaxSize: 64 << 20})
+//	binlog := New(Config{IOWriter: file, WriterControl: file, ...})
+//	file.SetDictionary(binlog)
+//
+// FrameStart() locks the file and rotates the file if required, FrameEnd()
+// unlocks the file. The rotated files are Filename.<timestamp>[.gz]
+// Every new file starts with the stream header and the dictionary. Set
+// ADD_DICTIONARY to get the format strings which appear after the rotation
+// in the same file. Every file can be decoded without other files
+type RotatingFile struct {
+	config     RotatingFileConfig
+	mutex      sync.Mutex
+	file       *os.File
+	size       int64
+	dataStart  int64 // size of the dictionary in the beginning of the file
+	openTime   time.Time
+	dictionary DictionaryWriter
+	statistics RotatingFileStatistics
+	now        func() time.Time
+
+	// Compression and removal of the old files run in the background
+	cleanup      sync.WaitGroup
+	cleanupMutex sync.Mutex
+}
+
+type RotatingFileStatistics struct {
+	Rotations uint64
+	Errors    uint64 // failed rotations, compressions and removals
+}
+
+// NewRotatingFile opens the file in the append mode
+func NewRotatingFile(config RotatingFileConfig) (*RotatingFile, error) {
+	r := &RotatingFile{config: config, now: time.Now}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetDictionary sets the source of the dictionary for the new files and
+// writes the dictionary. The file can contain the frames of another
+// logger, for example, of the process before a restart
+func (r *RotatingFile) SetDictionary(dictionary DictionaryWriter) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.dictionary = dictionary
+	return r.writeDictionary()
+}
+
+func (r *RotatingFile) FrameStart(io.Writer) {
+	r.mutex.Lock()
+	r.frameStarted()
+}
+
+func (r *RotatingFile) TryFrameStart(ioWriter io.Writer, timeout time.Duration) bool {
+	if !tryLock(&r.mutex, timeout) {
+		return false
+	}
+	r.frameStarted()
+	return true
+}
+
+func (r *RotatingFile) frameStarted() {
+	if r.shallRotate() {
+		if err := r.rotate(); err != nil {
+			r.statistics.Errors++
+		}
+	}
+}
+
+func (r *RotatingFile) FrameEnd(io.Writer) {
+	r.mutex.Unlock()
+}
+
+// Write is called between FrameStart() and FrameEnd()
+func (r *RotatingFile) Write(data []byte) (int, error) {
+	n, err := r.file.Write(data)
+	r.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the file after the current frame
+func (r *RotatingFile) Rotate() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.rotate()
+}
+
+func (r *RotatingFile) GetStatistics() RotatingFileStatistics {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.statistics
+}
+
+// Close closes the file and waits for the compression of the rotated files
+func (r *RotatingFile) Close() error {
+	r.mutex.Lock()
+	err := r.file.Close()
+	r.mutex.Unlock()
+	r.cleanup.Wait()
+	return err
+}
+
+// I rotate only if there is at least one frame after the dictionary
+func (r *RotatingFile) shallRotate() bool {
+	if r.size <= r.dataStart {
+		return false
+	}
+	if r.config.MaxSize > 0 && r.size >= r.config.MaxSize {
+		return true
+	}
+	if r.config.MaxAge > 0 && r.now().Sub(r.openTime) >= r.config.MaxAge {
+		return true
+	}
+	return false
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.config.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = fileInfo.Size()
+	r.dataStart = 0
+	r.openTime = r.now()
+	return nil
+}
+
+// Rename the file, open a new file, write the dictionary
+// If the rename fails I keep writing to the current file
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	backup := r.backupFilename()
+	if err := os.Rename(r.config.Filename, backup); err != nil {
+		// Somebody could remove the file, the new file needs the dictionary
+		if r.open() == nil && r.size == 0 {
+			r.writeDictionary()
+		}
+		return err
+	}
+	if err := r.open(); err != nil {
+		// Try to get the file back
+		if os.Rename(backup, r.config.Filename) == nil {
+			r.open()
+		}
+		return err
+	}
+	r.statistics.Rotations++
+	r.cleanup.Add(1)
+	go r.cleanupBackups()
+	return r.writeDictionary()
+}
+
+func (r *RotatingFile) writeDictionary() error {
+	if r.dictionary == nil {
+		return nil
+	}
+	err := r.dictionary.WriteDictionary(r)
+	r.dataStart = r.size
+	return err
+}
+
+// The backups are Filename.<timestamp>[-<sequence>][.gz]
+const backupTimestampFormat = "20060102-150405.000000"
+
+var backupSuffix = regexp.MustCompile(`^\.(\d{8}-\d{6}\.\d{6})(?:-(\d+))?(\.gz)?$`)
+
+// Timestamp sorts the backups by time
+func (r *RotatingFile) backupFilename() string {
+	timestamp := r.now().Format(backupTimestampFormat)
+	backup := fmt.Sprintf("%s.%s", r.config.Filename, timestamp)
+	for i := 1; fileExists(backup) || fileExists(backup+".gz"); i++ {
+		backup = fmt.Sprintf("%s.%s-%d", r.config.Filename, timestamp, i)
+	}
+	return backup
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// Compress the rotated files and remove the oldest files
+// The goroutines can run in any order, every goroutine handles all files
+func (r *RotatingFile) cleanupBackups() {
+	defer r.cleanup.Done()
+	r.cleanupMutex.Lock()
+	defer r.cleanupMutex.Unlock()
+	var errors uint64
+	backups := r.Backups()
+	if r.config.Compress {
+		for i, backup := range backups {
+			if strings.HasSuffix(backup, ".gz") {
+				continue
+			}
+			if err := compressFile(backup); err != nil {
+				errors++
+				continue
+			}
+			backups[i] = backup + ".gz"
+		}
+	}
+	if r.config.MaxBackups > 0 {
+		for len(backups) > r.config.MaxBackups {
+			if err := os.Remove(backups[0]); err != nil {
+				errors++
+			}
+			backups = backups[1:]
+		}
+	}
+	r.mutex.Lock()
+	r.statistics.Errors += errors
+	r.mutex.Unlock()
+}
+
+// Backups returns the rotated files, the oldest file first
+// Other files, for example, Filename.dict or the files being compressed,
+// are not backups
+func (r *RotatingFile) Backups() []string {
+	type backup struct {
+		filename  string
+		timestamp time.Time
+		sequence  int
+	}
+	matches, _ := filepath.Glob(r.config.Filename + ".*")
+	backups := []backup{}
+	for _, match := range matches {
+		if !strings.HasPrefix(match, r.config.Filename) {
+			continue
+		}
+		fields := backupSuffix.FindStringSubmatch(match[len(r.config.Filename):])
+		if fields == nil {
+			continue
+		}
+		timestamp, err := time.Parse(backupTimestampFormat, fields[1])
+		if err != nil {
+			continue
+		}
+		sequence, _ := strconv.Atoi(fields[2])
+		backups = append(backups, backup{match, timestamp, sequence})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].timestamp.Equal(backups[j].timestamp) {
+			return backups[i].timestamp.Before(backups[j].timestamp)
+		}
+		return backups[i].sequence < backups[j].sequence
+	})
+	filenames := make([]string, 0, len(backups))
+	for _, b := range backups {
+		filenames = append(filenames, b.filename)
+	}
+	return filenames
+}
+
+// Write filename.gz and remove the filename
+func compressFile(filename string) error {
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmpFilename := filename + ".gz.tmp"
+	dst, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	gzipWriter := gzip.NewWriter(dst)
+	_, err = io.Copy(gzipWriter, src)
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFilename, filename+".gz")
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return os.Remove(filename)
+}
@@ -0,0 +1,237 @@
+package binlog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Decode the file without the logger's dictionary
+func decodeFile(t *testing.T, filename string) []string {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.HasSuffix(filename, ".gz") {
+		if reader, err = gzip.NewReader(file); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	decoder := NewDecoder(reader, nil, &DecoderOptions{})
+	logs := []string{}
+	for decoder.Next() {
+		logs = append(logs, Format(decoder.Entry()))
+	}
+	if err := decoder.Err(); err != nil {
+		t.Fatalf("%s: %v", filename, err)
+	}
+	return logs
+}
+
+func TestRotatingFile(t *testing.T) {
+	ADD_DICTIONARY, ADD_FRAME_HEADER = true, true
+	defer func() { ADD_DICTIONARY, ADD_FRAME_HEADER = false, false }()
+	filename := filepath.Join(t.TempDir(), "binlog")
+	// Not a backup, the cleanup shall not remove the file
+	if err := os.WriteFile(filename+".dict", nil, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	file, err := NewRotatingFile(RotatingFileConfig{Filename: filename, MaxSize: 200, MaxBackups: 3, Compress: true})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: file, WriterControl: file, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	if err := file.SetDictionary(binlog); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []string{}
+	for i := 0; i < 40; i++ {
+		binlog.Log("Hello %d", i)
+		expected = append(expected, fmt.Sprintf("Hello %d", i))
+		binlog.Log("Hello %s %d", "world", i)
+		expected = append(expected, fmt.Sprintf("Hello world %d", i))
+	}
+	file.Close()
+
+	backups := file.Backups()
+	if len(backups) != 3 {
+		t.Fatalf("%d backups instead of 3: %v", len(backups), backups)
+	}
+	logs := []string{}
+	for _, backup := range backups {
+		if !strings.HasSuffix(backup, ".gz") {
+			t.Fatalf("Backup %s is not compressed", backup)
+		}
+		logs = append(logs, decodeFile(t, backup)...)
+	}
+	logs = append(logs, decodeFile(t, filename)...)
+	// The oldest files are removed, every file ends with a complete frame
+	expected = expected[len(expected)-len(logs):]
+	for i := range logs {
+		if logs[i] != expected[i] {
+			t.Fatalf("Print failed expected '%s', actual '%s'", expected[i], logs[i])
+		}
+	}
+	if statistics := file.GetStatistics(); statistics.Rotations < 4 || statistics.Errors != 0 {
+		t.Fatalf("Unexpected statistics %v", statistics)
+	}
+	if !fileExists(filename + ".dict") {
+		t.Fatalf("The cleanup removed %s.dict", filename)
+	}
+}
+
+func TestRotatingFileBackups(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "binlog")
+	files := []string{
+		".20240101-000000.000000-2.gz",
+		".20240101-000000.000000.gz",
+		".20231231-235959.999999",
+		".20240101-000000.000000-10",
+		".20240101-000000.000000-1",
+		".dict",
+		".lock",
+		".20240101-000000.000000.gz.tmp",
+	}
+	for _, suffix := range files {
+		if err := os.WriteFile(filename+suffix, nil, 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	file, err := NewRotatingFile(RotatingFileConfig{Filename: filename})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer file.Close()
+	expected := []string{files[2], files[1], files[4], files[0], files[3]}
+	backups := file.Backups()
+	if len(backups) != len(expected) {
+		t.Fatalf("Unexpected backups %v", backups)
+	}
+	for i := range expected {
+		if backups[i] != filename+expected[i] {
+			t.Fatalf("Unexpected backups %v", backups)
+		}
+	}
+}
+
+// The logger keeps writing to the file if the rotation fails
+func TestRotatingFileRenameFailure(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "binlog")
+	file, err := NewRotatingFile(RotatingFileConfig{Filename: filename})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: file, WriterControl: file, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	file.SetDictionary(binlog)
+	binlog.Log("Hello %d", 1)
+	os.Remove(filename)
+	if err := file.Rotate(); err == nil {
+		t.Fatalf("Rotation of the removed file succeeded")
+	}
+	binlog.Log("Hello %d", 2)
+	file.Close()
+	if logs := decodeFile(t, filename); len(logs) != 1 || logs[0] != "Hello 2" {
+		t.Fatalf("Unexpected logs %v in %s", logs, filename)
+	}
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	ADD_DICTIONARY = true
+	defer func() { ADD_DICTIONARY = false }()
+	filename := filepath.Join(t.TempDir(), "binlog")
+	file, err := NewRotatingFile(RotatingFileConfig{Filename: filename, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	now := time.Now()
+	file.now = func() time.Time { return now }
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: file, WriterControl: file, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	file.SetDictionary(binlog)
+
+	binlog.Log("Hello %d", 1)
+	now = now.Add(30 * time.Minute)
+	binlog.Log("Hello %d", 2)
+	now = now.Add(30 * time.Minute)
+	binlog.Log("Hello %d", 3)
+	file.Close()
+
+	backups := file.Backups()
+	if len(backups) != 1 {
+		t.Fatalf("%d backups instead of 1: %v", len(backups), backups)
+	}
+	if logs := decodeFile(t, backups[0]); len(logs) != 2 || logs[1] != "Hello 2" {
+		t.Fatalf("Unexpected logs %v in %s", logs, backups[0])
+	}
+	if logs := decodeFile(t, filename); len(logs) != 1 || logs[0] != "Hello 3" {
+		t.Fatalf("Unexpected logs %v in %s", logs, filename)
+	}
+}
+
+// Every file starts a new intern table, the decoder reads one file
+func TestRotatingFileInternTable(t *testing.T) {
+	ADD_DICTIONARY, ADD_FRAME_HEADER, INTERN_TABLE_SIZE = true, true, 4
+	defer func() { ADD_DICTIONARY, ADD_FRAME_HEADER, INTERN_TABLE_SIZE = false, false, 0 }()
+	filename := filepath.Join(t.TempDir(), "binlog")
+	file, err := NewRotatingFile(RotatingFileConfig{Filename: filename, MaxSize: 300})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	binlog := New(Config{IOWriter: file, WriterControl: file, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+	file.SetDictionary(binlog)
+	paths := []string{fmt.Sprintf("/%s", "first"), fmt.Sprintf("/%s", "second"), fmt.Sprintf("/%s", "third")}
+	expected := []string{}
+	for i := 0; i < 30; i++ {
+		binlog.Log("Path %s", paths[i%len(paths)])
+		expected = append(expected, "Path "+paths[i%len(paths)])
+	}
+	file.Close()
+	logs := []string{}
+	for _, backup := range file.Backups() {
+		logs = append(logs, decodeFile(t, backup)...)
+	}
+	logs = append(logs, decodeFile(t, filename)...)
+	if len(logs) != len(expected) || file.GetStatistics().Rotations == 0 {
+		t.Fatalf("Decoded %d logs instead of %d", len(logs), len(expected))
+	}
+	for i := range logs {
+		if logs[i] != expected[i] {
+			t.Fatalf("Print failed expected '%s', actual '%s'", expected[i], logs[i])
+		}
+	}
+}
+
+// The restarted process appends to the file, the file contains the
+// dictionaries of both processes
+func TestRotatingFileAppend(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "binlog")
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	for i := 0; i < 2; i++ {
+		// The process logged before the process opened the file
+		binlog := New(Config{IOWriter: io.Discard, WriterControl: &WriterControlDummy{}, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+		// The processes use different format strings
+		format := fmt.Sprintf("Process %d %%s", i)
+		binlog.Log(format, "started")
+		file, err := NewRotatingFile(RotatingFileConfig{Filename: filename})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		binlog.config.IOWriter, binlog.config.WriterControl = file, file
+		file.SetDictionary(binlog)
+		binlog.Log(format, "started")
+		file.Close()
+	}
+	if logs := decodeFile(t, filename); len(logs) != 2 || logs[1] != "Process 1 started" {
+		t.Fatalf("Unexpected logs %v in %s", logs, filename)
+	}
+}
@@ -0,0 +1,184 @@
+package binlog
+
+import (
+	"encoding/binary"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WriterControlMutex allows many loggers to share one io.Writer. All
+// loggers sharing the io.Writer shall use the same WriterControlMutex:
+//
+//	writerControl := &WriterControlMutex{}
+//	binlog1 := New(Config{IOWriter: file, WriterControl: writerControl, ...})
+//	binlog2 := New(Config{IOWriter: file, WriterControl: writerControl, ...})
+type WriterControlMutex struct {
+	mutex sync.Mutex
+}
+
+func (w *WriterControlMutex) FrameStart(io.Writer) {
+	w.mutex.Lock()
+}
+
+func (w *WriterControlMutex) TryFrameStart(ioWriter io.Writer, timeout time.Duration) bool {
+	return tryLock(&w.mutex, timeout)
+}
+
+func (w *WriterControlMutex) FrameEnd(io.Writer) {
+	w.mutex.Unlock()
+}
+
+// WriterControlSpinlock is a WriterControlMutex which does not park the
+// goroutine. The frames are short, the spinlock can be faster than the mutex
+// if the io.Writer is a memory buffer
+type WriterControlSpinlock struct {
+	state int32
+}
+
+func (w *WriterControlSpinlock) FrameStart(io.Writer) {
+	for !atomic.CompareAndSwapInt32(&w.state, 0, 1) {
+		runtime.Gosched()
+	}
+}
+
+func (w *WriterControlSpinlock) TryFrameStart(ioWriter io.Writer, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !atomic.CompareAndSwapInt32(&w.state, 0, 1) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		runtime.Gosched()
+	}
+	return true
+}
+
+func (w *WriterControlSpinlock) FrameEnd(io.Writer) {
+	atomic.StoreInt32(&w.state, 0)
+}
+
+// WriterControlFrameBuffer collects the frame and writes the frame to the
+// io.Writer in one call to Write(). Every logger has it's own
+// WriterControlFrameBuffer. If the io.Writer is an O_APPEND file, a pipe
+// (frames below PIPE_BUF) or a datagram socket the frames of different
+// loggers do not interleave. Otherwise the loggers shall share a Locker:
+//
+//	mutex := &sync.Mutex{}
+//	frameBuffer1 := NewWriterControlFrameBuffer(file, mutex)
+//	binlog1 := New(Config{IOWriter: frameBuffer1, WriterControl: frameBuffer1, ...})
+//	frameBuffer2 := NewWriterControlFrameBuffer(file, mutex)
+//	binlog2 := New(Config{IOWriter: frameBuffer2, WriterControl: frameBuffer2, ...})
+//
+// The Locker is held only while the frame is written
+type WriterControlFrameBuffer struct {
+	ioWriter io.Writer
+	locker   sync.Locker
+	frame    []byte
+	err      error
+}
+
+// If locker is nil the frame buffer relies on the io.Writer
+func NewWriterControlFrameBuffer(ioWriter io.Writer, locker sync.Locker) *WriterControlFrameBuffer {
+	return &WriterControlFrameBuffer{ioWriter: ioWriter, locker: locker}
+}
+
+func (w *WriterControlFrameBuffer) FrameStart(io.Writer) {
+	w.frame = w.frame[:0]
+}
+
+func (w *WriterControlFrameBuffer) FrameEnd(io.Writer) {
+	w.flush(w.frame)
+}
+
+// Write is called between FrameStart() and FrameEnd()
+func (w *WriterControlFrameBuffer) Write(data []byte) (int, error) {
+	w.frame = append(w.frame, data...)
+	return len(data), nil
+}
+
+// Err returns the last error of the io.Writer
+func (w *WriterControlFrameBuffer) Err() error {
+	return w.err
+}
+
+func (w *WriterControlFrameBuffer) flush(data []byte) {
+	if w.locker != nil {
+		w.locker.Lock()
+		defer w.locker.Unlock()
+	}
+	if _, err := w.ioWriter.Write(data); err != nil {
+		w.err = err
+	}
+}
+
+// WriterControlLengthPrefix is a WriterControlFrameBuffer which adds 4 bytes
+// size of the frame before the frame. Unlike ADD_FRAME_HEADER the prefix
+// does not require the global flag and does not have the sync marker. See
+// NewLengthPrefixReader()
+type WriterControlLengthPrefix struct {
+	WriterControlFrameBuffer
+}
+
+func NewWriterControlLengthPrefix(ioWriter io.Writer, locker sync.Locker) *WriterControlLengthPrefix {
+	return &WriterControlLengthPrefix{WriterControlFrameBuffer{ioWriter: ioWriter, locker: locker}}
+}
+
+func (w *WriterControlLengthPrefix) FrameStart(io.Writer) {
+	w.frame = append(w.frame[:0], 0, 0, 0, 0) // the size of the frame
+}
+
+func (w *WriterControlLengthPrefix) FrameEnd(io.Writer) {
+	binary.LittleEndian.PutUint32(w.frame, uint32(len(w.frame)-4))
+	w.flush(w.frame)
+}
+
+// lengthPrefixReader removes the prefixes added by WriterControlLengthPrefix
+type lengthPrefixReader struct {
+	reader io.Reader
+	left   uint32 // bytes left in the current frame
+	prefix [4]byte
+}
+
+// NewLengthPrefixReader returns the stream without the length prefixes,
+// for example, for NewDecoder(). The reader returns io.ErrUnexpectedEOF if
+// the stream ends in the middle of a frame
+func NewLengthPrefixReader(reader io.Reader) io.Reader {
+	return &lengthPrefixReader{reader: reader}
+}
+
+func (r *lengthPrefixReader) Read(data []byte) (int, error) {
+	for r.left == 0 {
+		if _, err := io.ReadFull(r.reader, r.prefix[:]); err != nil {
+			return 0, err
+		}
+		r.left = binary.LittleEndian.Uint32(r.prefix[:])
+	}
+	if uint32(len(data)) > r.left {
+		data = data[:r.left]
+	}
+	n, err := r.reader.Read(data)
+	r.left -= uint32(n)
+	if err == io.EOF {
+		err = nil
+		if r.left != 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+// tryLock locks the mutex unless somebody holds the mutex longer than the
+// timeout, for example, the goroutine which panics between FrameStart() and
+// FrameEnd() and calls a panic hook
+func tryLock(mutex *sync.Mutex, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !mutex.TryLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package binlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"testing"
+)
+
+// Every goroutine logs to the shared writer with it's own logger
+// newLogger returns the IOWriter and the WriterControl of the logger
+func logConcurrently(t *testing.T, goroutines int, count int, newLogger func() (io.Writer, WriterControl)) *Dictionary {
+	constDataBase, constDataSize := GetSelfTextAddressSize()
+	var dictionary *Dictionary
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		ioWriter, writerControl := newLogger()
+		binlog := New(Config{IOWriter: ioWriter, WriterControl: writerControl, ConstDataBase: constDataBase, ConstDataSize: constDataSize, Timestamp: TimestampDummy})
+		dictionary = binlog.GetDictionary()
+		wg.Add(1)
+		go func(goroutine int) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				binlog.Log("Goroutine %d %d", goroutine, j)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return dictionary
+}
+
+// Every goroutine shall log all entries in order
+func expectConcurrentLogs(t *testing.T, reader io.Reader, dictionary *Dictionary, goroutines int, count int) {
+	decoder := NewDecoder(reader, dictionary, nil)
+	next := make([]int, goroutines)
+	for decoder.Next() {
+		args := decoder.Entry().Args
+		goroutine, j := args[0].(int), args[1].(int)
+		if next[goroutine] != j {
+			t.Fatalf("Goroutine %d expected %d, actual %d", goroutine, next[goroutine], j)
+		}
+		next[goroutine]++
+	}
+	if err := decoder.Err(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for goroutine, j := range next {
+		if j != count {
+			t.Fatalf("Goroutine %d expected %d logs, actual %d", goroutine, count, j)
+		}
+	}
+}
+
+func TestWriterControlMutex(t *testing.T) {
+	var buf bytes.Buffer
+	writerControl := &WriterControlMutex{}
+	dictionary := logConcurrently(t, 8, 1000, func() (io.Writer, WriterControl) {
+		return &buf, writerControl
+	})
+	expectConcurrentLogs(t, &buf, dictionary, 8, 1000)
+}
+
+func TestWriterControlSpinlock(t *testing.T) {
+	var buf bytes.Buffer
+	writerControl := &WriterControlSpinlock{}
+	dictionary := logConcurrently(t, 8, 1000, func() (io.Writer, WriterControl) {
+		return &buf, writerControl
+	})
+	expectConcurrentLogs(t, &buf, dictionary, 8, 1000)
+}
+
+// frameWriter keeps the writes separately
+type frameWriter struct {
+	mutex  sync.Mutex
+	frames [][]byte
+}
+
+func (w *frameWriter) Write(data []byte) (int, error) {
+	w.mutex.Lock()
+	w.frames = append(w.frames, append([]byte{}, data...))
+	w.mutex.Unlock()
+	return len(data), nil
+}
+
+func TestWriterControlFrameBuffer(t *testing.T) {
+	ioWriter := &frameWriter{}
+	dictionary := logConcurrently(t, 8, 1000, func() (io.Writer, WriterControl) {
+		frameBuffer := NewWriterControlFrameBuffer(ioWriter, nil)
+		return frameBuffer, frameBuffer
+	})
+	if len(ioWriter.frames) != 8*1000 {
+		t.Fatalf("Expected %d writes, actual %d", 8*1000, len(ioWriter.frames))
+	}
+	// Every write is a complete log entry
+	for _, frame := range ioWriter.frames {
+		decoder := NewDecoder(bytes.NewReader(frame), dictionary, nil)
+		if !decoder.Next() || decoder.Next() || decoder.Err() != nil {
+			t.Fatalf("Not a frame %v, %v", frame, decoder.Err())
+		}
+	}
+	expectConcurrentLogs(t, bytes.NewReader(bytes.Join(ioWriter.frames, nil)), dictionary, 8, 1000)
+
+	var buf bytes.Buffer
+	mutex := &sync.Mutex{}
+	dictionary = logConcurrently(t, 8, 1000, func() (io.Writer, WriterControl) {
+		frameBuffer := NewWriterControlFrameBuffer(&buf, mutex)
+		return frameBuffer, frameBuffer
+	})
+	expectConcurrentLogs(t, &buf, dictionary, 8, 1000)
+}
+
+func TestWriterControlLengthPrefix(t *testing.T) {
+	var buf bytes.Buffer
+	mutex := &sync.Mutex{}
+	dictionary := logConcurrently(t, 8, 1000, func() (io.Writer, WriterControl) {
+		lengthPrefix := NewWriterControlLengthPrefix(&buf, mutex)
+		return lengthPrefix, lengthPrefix
+	})
+	data := buf.Bytes()
+	for offset := 0; offset < len(data); {
+		size := int(binary.LittleEndian.Uint32(data[offset:]))
+		if size == 0 || offset+4+size > len(data) {
+			t.Fatalf("Bad prefix %d at offset %d", size, offset)
+		}
+		offset += 4 + size
+	}
+	expectConcurrentLogs(t, NewLengthPrefixReader(bytes.NewReader(data)), dictionary, 8, 1000)
+
+	// The stream ends in the middle of a frame
+	_, err := io.ReadAll(NewLengthPrefixReader(bytes.NewReader(data[:len(data)-1])))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected %v, actual %v", io.ErrUnexpectedEOF, err)
+	}
+}